@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"goapp/kvstore"
+)
+
+// Admin endpoints are served out of API base path
+// TODO: admin endpoints must be authorized separately from API endpoints
+
+// RestoreRequest is the body of Restore, filename is one of the files listed by Snapshots
+type RestoreRequest struct {
+	Filename string `json:"filename"`
+}
+
+// RestoreResponse is the response of Restore
+type RestoreResponse struct {
+	Filename string `json:"filename"`
+	Keys     int    `json:"keys"`
+}
+
+// StatsResponse is the response of Stats, counters of the store and the number of snapshot files
+type StatsResponse struct {
+	kvstore.Stats
+	Snapshots int `json:"snapshots"`
+}
+
+// Snapshot admin operation persists the current dict now, regardless of changes since the latest snapshot
+// Responds the written file and its hash
+func (s *ServiceX) Snapshot(w http.ResponseWriter, r *http.Request) {
+	// Execute the operation on store, then wait the file from persistance
+	ctx, cancel := s.context(r)
+	defer cancel()
+	info, _err := s.store.Snapshot(ctx)
+	if s.failed(w, _err) {
+		return
+	} else if _err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Snapshot failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+		return
+	}
+	jsonStr, _ := json.Marshal(info)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonStr)
+	log.Printf("INFO Snapshot completed. RequestId: %v, file:%v\r\n", w.Header().Get("x-request-id"), info.Filename)
+}
+
+// Snapshots admin operation lists snapshot files in data directory with sizes and timestamps, the latest is the first
+func (s *ServiceX) Snapshots(w http.ResponseWriter, r *http.Request) {
+	infos, _err := s.store.Snapshots()
+	if _err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Snapshots failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+		return
+	}
+	jsonStr, _ := json.Marshal(infos)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+	log.Printf("INFO Snapshots completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+}
+
+// Restore admin operation loads a snapshot file into the live dict, all current keys are replaced
+// The file is read and verified by the handler, then the dict is replaced by store
+// Responds 404 if the file is not a snapshot of data directory, 422 if it is corrupted
+func (s *ServiceX) Restore(w http.ResponseWriter, r *http.Request) {
+	var body RestoreRequest
+	var _err = json.NewDecoder(r.Body).Decode(&body)
+	if _err != nil || body.Filename == "" {
+		http.Error(w, "filename is required", http.StatusBadRequest)
+		return
+	}
+	dict, _err := s.store.ReadSnapshot(body.Filename)
+	if errors.Is(_err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("WARN Restore file not found. RequestId: %v, file:%v\r\n", w.Header().Get("x-request-id"), body.Filename)
+		return
+	} else if _err != nil {
+		http.Error(w, _err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("ERROR Restore failed. RequestId: %v, file:%v, err:%v\r\n", w.Header().Get("x-request-id"), body.Filename, _err)
+		return
+	}
+
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	keys := len(dict) // the dict belongs to store once it is sent
+	_err = s.store.Restore(ctx, dict)
+	if s.failed(w, _err) {
+		return
+	} else if _err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Restore failed. RequestId: %v, file:%v, err:%v\r\n", w.Header().Get("x-request-id"), body.Filename, _err)
+		return
+	}
+
+	jsonStr, _ := json.Marshal(RestoreResponse{Filename: body.Filename, Keys: keys})
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+	log.Printf("INFO Restore completed. RequestId: %v, file:%v\r\n", w.Header().Get("x-request-id"), body.Filename)
+}
+
+// Stats admin operation responds the number of live keys, their size and the latest version of the store
+func (s *ServiceX) Stats(w http.ResponseWriter, r *http.Request) {
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	stats, _err := s.store.Stats(ctx)
+	if s.failed(w, _err) {
+		return
+	} else if _err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Stats failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+		return
+	}
+	resp := StatsResponse{Stats: stats}
+	if infos, _err := s.store.Snapshots(); _err == nil {
+		resp.Snapshots = len(infos)
+	}
+	jsonStr, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+	log.Printf("INFO Stats completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+}
@@ -0,0 +1,520 @@
+// Package client is the Go client of GOAPP REST API
+// Each request is sent with Content-Type: application/json (or the format of import) and a x-request-id header,
+// a new uuid is generated per call unless the context carries one, see WithRequestId. Retries of a call use the same id
+// Failed calls return *Error, check its kind with errors.Is against ErrNotFound, ErrConflict, ErrPreconditionFailed and ErrUnsupportedMediaType
+//
+//	c := client.NewClient("http://localhost:8080")
+//	if _, err := c.Set(ctx, "key1", "value1", client.SetOptions{Upsert: true}); err != nil {
+//		log.Fatal(err)
+//	}
+//	item, err := c.Get(ctx, "key1")
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const API_PATH = "/api/v1/my"
+
+// Export and import formats
+const (
+	FORMAT_NDJSON = "application/x-ndjson" // a JSON record per line
+	FORMAT_CSV    = "text/csv"             // key,value,ttl columns with a header row
+)
+
+// Import modes
+const (
+	IMPORT_MERGE   = "merge"   // existing keys are kept, imported pairs of existing keys are skipped
+	IMPORT_REPLACE = "replace" // store holds only the imported pairs afterwards
+)
+
+// Errors to check the kind of *Error with errors.Is
+var (
+	ErrNotFound             = errors.New("not found")
+	ErrConflict             = errors.New("conflict")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// Error is returned when the server responds an unexpected status
+// Keys lists the existing keys of a conflicting Create, Current holds the current pair of a conflicting CompareAndSwap or CompareAndDelete
+type Error struct {
+	StatusCode int
+	RequestId  string
+	Message    string
+	Keys       []string
+	Current    map[string]string
+}
+
+func (e *Error) Error() string {
+	msg := strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg + " (x-request-id: " + e.RequestId + ")"
+}
+
+// Is matches ErrNotFound, ErrConflict, ErrPreconditionFailed and ErrUnsupportedMediaType by status code
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case ErrUnsupportedMediaType:
+		return e.StatusCode == http.StatusUnsupportedMediaType
+	}
+	return false
+}
+
+// RetryPolicy decides how a failed call is retried
+// Retries is the number of retries after the first attempt, the wait before a retry starts with Backoff and doubles up to MaxBackoff
+// A 503 response is always retried since the server did not take the operation, Retry-After of the response is waited if it is longer
+// Network errors and 502, 504 responses are retried only for GET and PUT without If-Match or If-None-Match, other operations
+// may have been executed and would not give the same result again, e.g. a retried DELETE fails with ErrNotFound
+type RetryPolicy struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy gives 3 retries starting with 100ms wait up to 2s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Retries: 3, Backoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+}
+
+// wait gives the wait before given retry, a random jitter up to half of the wait spreads retries of several clients
+func (p RetryPolicy) wait(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type requestIdKey struct{}
+
+// WithRequestId gives a context whose calls are sent with given x-request-id, a service can propagate the id of its own request
+// The server accepts only uuids, any other value is replaced by a new uuid
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// Client calls GOAPP REST API at baseURL, it is safe for concurrent use
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// NewClient creates a client of the server at baseURL (e.g. http://localhost:8080)
+// with an optional *http.Client, default is http.DefaultClient
+// and an optional RetryPolicy, default is DefaultRetryPolicy
+func NewClient(baseURL string, args ...interface{}) *Client {
+	c := Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: http.DefaultClient, retry: DefaultRetryPolicy()}
+	for _, arg := range args {
+		switch t := arg.(type) {
+		case *http.Client:
+			c.httpClient = t
+		case RetryPolicy:
+			c.retry = t
+		default:
+			panic("Unknown argument")
+		}
+	}
+	return &c
+}
+
+// request is a call of an endpoint, body is sent with contentType and replayed on retries
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	header      http.Header
+	body        []byte
+	contentType string
+}
+
+// do sends the request with retries and gives the response of an expected status, the caller closes its body
+// Other statuses are returned as *Error, the body of the error response is kept in Message
+func (c *Client) do(ctx context.Context, req request, expected ...int) (*http.Response, error) {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+	target := c.baseURL + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+	if req.contentType == "" {
+		req.contentType = "application/json"
+	}
+	// a conditional PUT which has been executed fails its precondition when it is sent again
+	idempotent := req.method == "GET" ||
+		(req.method == "PUT" && req.header.Get("If-Match") == "" && req.header.Get("If-None-Match") == "")
+
+	for retry := 0; ; retry++ {
+		r, err := http.NewRequestWithContext(ctx, req.method, target, bytes.NewReader(req.body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Content-Type", req.contentType)
+		r.Header.Set("x-request-id", requestId)
+
+		resp, err := c.httpClient.Do(r)
+		var wait time.Duration
+		if err != nil {
+			if !idempotent || ctx.Err() != nil || retry >= c.retry.Retries {
+				return nil, err
+			}
+		} else {
+			for _, code := range expected {
+				if resp.StatusCode == code {
+					return resp, nil
+				}
+			}
+			retriable := resp.StatusCode == http.StatusServiceUnavailable ||
+				(idempotent && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout))
+			if !retriable || retry >= c.retry.Retries {
+				return nil, newError(resp, requestId)
+			}
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if backoff := c.retry.wait(retry + 1); backoff > wait {
+			wait = backoff
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// newError reads an error response and closes its body
+func newError(resp *http.Response, requestId string) *Error {
+	defer resp.Body.Close()
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := Error{StatusCode: resp.StatusCode, RequestId: resp.Header.Get("x-request-id"), Message: strings.TrimSpace(string(buf))}
+	if e.RequestId == "" {
+		e.RequestId = requestId
+	}
+	return &e
+}
+
+// call sends the request and decodes the response of an expected status into result if it is not nil
+func (c *Client) call(ctx context.Context, req request, result interface{}, expected ...int) (*http.Response, error) {
+	resp, err := c.do(ctx, req, expected...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return resp, fmt.Errorf("cannot decode response of %v %v: %w", req.method, req.path, err)
+		}
+	}
+	return resp, nil
+}
+
+// keyPath gives the path of a key, keys are escaped but cannot contain a slash since the server routes by path segments
+func keyPath(key string, suffix ...string) string {
+	return API_PATH + "/keys/" + url.PathEscape(key) + strings.Join(suffix, "")
+}
+
+// ttlHeader gives x-ttl header in seconds for a positive ttl, rounded up to a second
+func ttlHeader(ttl time.Duration) http.Header {
+	header := http.Header{}
+	if ttl > 0 {
+		header.Set("x-ttl", strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10))
+	}
+	return header
+}
+
+// Item is a pair with its version and remaining time to live as responded by Get, zero TTL never expires
+type Item struct {
+	Key   string
+	Value string
+	ETag  string
+	TTL   time.Duration
+}
+
+// Create writes all given pairs in a single operation, zero ttl never expires. Gives the written pairs
+// If any of the keys exists nothing is written and ErrConflict is returned, Keys of the *Error lists the existing keys
+func (c *Client) Create(ctx context.Context, pairs map[string]string, ttl time.Duration) (map[string]string, error) {
+	body, _ := json.Marshal(pairs)
+	written := make(map[string]string)
+	_, err := c.call(ctx, request{method: "POST", path: API_PATH + "/keys", header: ttlHeader(ttl), body: body}, &written, http.StatusCreated)
+	var e *Error
+	if errors.As(err, &e) && (e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed) {
+		json.Unmarshal([]byte(e.Message), &e.Keys)
+	}
+	return written, err
+}
+
+// SetOptions are the options of Set
+// TTL is the time to live of the value, zero never expires. Upsert creates a missing key instead of failing with ErrNotFound
+// IfMatch writes only if the ETag of the current value matches, IfNoneMatch: * writes only if the key does not exist
+type SetOptions struct {
+	TTL         time.Duration
+	Upsert      bool
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// Set replaces the value of a key, gives true if the key is created
+// Fails with ErrNotFound if the key does not exist and it is not upserted, ErrPreconditionFailed if a precondition fails
+func (c *Client) Set(ctx context.Context, key string, value string, opts SetOptions) (bool, error) {
+	body, _ := json.Marshal(map[string]string{key: value})
+	req := request{method: "PUT", path: keyPath(key), header: ttlHeader(opts.TTL), body: body}
+	if opts.Upsert {
+		req.query = url.Values{"upsert": {"true"}}
+	}
+	if opts.IfMatch != "" {
+		req.header.Set("If-Match", opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		req.header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	resp, err := c.call(ctx, req, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// Get gives the value of a key with its ETag and remaining time to live, ErrNotFound if the key does not exist
+func (c *Client) Get(ctx context.Context, key string) (Item, error) {
+	pair := make(map[string]string)
+	resp, err := c.call(ctx, request{method: "GET", path: keyPath(key)}, &pair, http.StatusOK)
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{Key: key, Value: pair[key], ETag: resp.Header.Get("ETag")}
+	if seconds, err := strconv.ParseInt(resp.Header.Get("x-ttl"), 10, 64); err == nil {
+		item.TTL = time.Duration(seconds) * time.Second
+	}
+	return item, nil
+}
+
+// ListOptions are the options of List, zero Limit gives the default page size of the server
+// Cursor is the cursor of the previous page, Values asks the values of the keys too
+type ListOptions struct {
+	Prefix string
+	Limit  int
+	Cursor string
+	Values bool
+}
+
+// ListResponse is a page of List, Cursor is empty on the last page
+type ListResponse struct {
+	Keys   []string          `json:"keys"`
+	Pairs  map[string]string `json:"pairs,omitempty"`
+	Cursor string            `json:"cursor,omitempty"`
+}
+
+// List gives a page of keys in order
+func (c *Client) List(ctx context.Context, opts ListOptions) (ListResponse, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.Values {
+		query.Set("values", "true")
+	}
+	var page ListResponse
+	_, err := c.call(ctx, request{method: "GET", path: API_PATH + "/keys", query: query}, &page, http.StatusOK)
+	return page, err
+}
+
+// Delete removes a key, ErrNotFound if the key does not exist
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.call(ctx, request{method: "DELETE", path: keyPath(key)}, nil, http.StatusNoContent)
+	return err
+}
+
+// DeleteAll removes all keys
+func (c *Client) DeleteAll(ctx context.Context) error {
+	_, err := c.call(ctx, request{method: "DELETE", path: API_PATH + "/keys"}, nil, http.StatusNoContent)
+	return err
+}
+
+// CompareAndSwap writes the value only if the current value is the expected one, nil expects the key does not exist
+// Gives the ETag of the new value. On mismatch ErrConflict is returned, Current of the *Error holds the current pair (empty if the key does not exist)
+func (c *Client) CompareAndSwap(ctx context.Context, key string, expected *string, value string, ttl time.Duration) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{"expected": expected, "value": value})
+	resp, err := c.call(ctx, request{method: "POST", path: keyPath(key, "/cas"), header: ttlHeader(ttl), body: body}, nil, http.StatusOK)
+	if err != nil {
+		return "", current(err)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompareAndDelete removes the key only if the current value is the expected one
+// Fails with ErrNotFound if the key does not exist, on mismatch ErrConflict is returned and Current of the *Error holds the current pair
+func (c *Client) CompareAndDelete(ctx context.Context, key string, expected string) error {
+	body, _ := json.Marshal(map[string]string{"expected": expected})
+	_, err := c.call(ctx, request{method: "POST", path: keyPath(key, "/cad"), body: body}, nil, http.StatusNoContent)
+	return current(err)
+}
+
+// current decodes the current pair of a conflict error
+func current(err error) error {
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusConflict {
+		json.Unmarshal([]byte(e.Message), &e.Current)
+	}
+	return err
+}
+
+// Increment adds delta to the numeric value of a key and gives the new value, a missing key counts as zero
+func (c *Client) Increment(ctx context.Context, key string, delta json.Number) (string, error) {
+	return c.increment(ctx, key, "/incr", delta)
+}
+
+// Decrement subtracts delta from the numeric value of a key and gives the new value, a missing key counts as zero
+func (c *Client) Decrement(ctx context.Context, key string, delta json.Number) (string, error) {
+	return c.increment(ctx, key, "/decr", delta)
+}
+
+func (c *Client) increment(ctx context.Context, key string, op string, delta json.Number) (string, error) {
+	body, _ := json.Marshal(map[string]json.Number{"delta": delta})
+	pair := make(map[string]string)
+	if _, err := c.call(ctx, request{method: "POST", path: keyPath(key, op), body: body}, &pair, http.StatusOK); err != nil {
+		return "", err
+	}
+	return pair[key], nil
+}
+
+// ExportRecord is a pair in NDJSON export and import, ttl is the remaining time to live in seconds, zero never expires
+type ExportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// Export streams all pairs with given prefix in FORMAT_NDJSON or FORMAT_CSV, the caller closes the stream
+// A stream closed early by the server is read as an unexpected EOF
+func (c *Client) Export(ctx context.Context, prefix string, format string) (io.ReadCloser, error) {
+	req := request{method: "GET", path: API_PATH + "/export", header: http.Header{"Accept": {format}}}
+	if prefix != "" {
+		req.query = url.Values{"prefix": {prefix}}
+	}
+	resp, err := c.do(ctx, req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// ImportResponse is the summary of Import
+type ImportResponse struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Invalid  int `json:"invalid"`
+	Deleted  int `json:"deleted"`
+}
+
+// Import reads pairs in FORMAT_NDJSON or FORMAT_CSV and writes them in IMPORT_MERGE or IMPORT_REPLACE mode
+// The body is read into memory so that it can be sent again on a 503 response
+func (c *Client) Import(ctx context.Context, body io.Reader, format string, mode string) (ImportResponse, error) {
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return ImportResponse{}, err
+	}
+	var resp ImportResponse
+	req := request{method: "POST", path: API_PATH + "/import", query: url.Values{"mode": {mode}}, body: buf, contentType: format}
+	_, err = c.call(ctx, req, &resp, http.StatusOK)
+	return resp, err
+}
+
+// SnapshotInfo is a snapshot file in the data directory of the server
+type SnapshotInfo struct {
+	Filename string    `json:"filename"`
+	Hash     string    `json:"hash,omitempty"`
+	KeyId    string    `json:"key_id,omitempty"`
+	Deltas   int       `json:"deltas,omitempty"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// Snapshot persists the current dict now and gives the written file
+func (c *Client) Snapshot(ctx context.Context) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	_, err := c.call(ctx, request{method: "POST", path: "/admin/snapshot"}, &info, http.StatusCreated)
+	return info, err
+}
+
+// Snapshots lists snapshot files, the latest is the first
+func (c *Client) Snapshots(ctx context.Context) ([]SnapshotInfo, error) {
+	var infos []SnapshotInfo
+	_, err := c.call(ctx, request{method: "GET", path: "/admin/snapshots"}, &infos, http.StatusOK)
+	return infos, err
+}
+
+// Restore replaces all keys with the pairs of a snapshot file listed by Snapshots and gives the number of restored keys
+// Fails with ErrNotFound if the file is not a snapshot of the server
+func (c *Client) Restore(ctx context.Context, filename string) (int, error) {
+	body, _ := json.Marshal(map[string]string{"filename": filename})
+	var resp struct {
+		Keys int `json:"keys"`
+	}
+	_, err := c.call(ctx, request{method: "POST", path: "/admin/restore", body: body}, &resp, http.StatusOK)
+	return resp.Keys, err
+}
+
+// Stats are the counters of the server, Bytes is the total length of live keys and values
+// Expiring is the number of keys with a time to live, Version is the latest version given to a write
+type Stats struct {
+	Keys      int    `json:"keys"`
+	Expiring  int    `json:"expiring"`
+	Bytes     int64  `json:"bytes"`
+	Version   uint64 `json:"version"`
+	Shards    int    `json:"shards"`
+	Snapshots int    `json:"snapshots"`
+}
+
+// Stats gives the counters of the server
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	_, err := c.call(ctx, request{method: "GET", path: "/admin/stats"}, &stats, http.StatusOK)
+	return stats, err
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var fastRetry = RetryPolicy{Retries: 2, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func TestHeaders(t *testing.T) {
+	var requestIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("---> TEST: Got Content-Type %v, expected application/json", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("x-ttl") != "2" {
+			t.Errorf("---> TEST: Got x-ttl %v, expected 2", r.Header.Get("x-ttl"))
+		}
+		requestIds = append(requestIds, r.Header.Get("x-request-id"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, fastRetry)
+	ctx := context.Background()
+	c.Set(ctx, "key1", "value1", SetOptions{TTL: 1500 * time.Millisecond})
+	c.Set(WithRequestId(ctx, "8e3c1d8a-4b36-4c5e-9d57-0f5d2a4c9b11"), "key1", "value1", SetOptions{TTL: 2 * time.Second})
+
+	if _, err := uuid.Parse(requestIds[0]); err != nil {
+		t.Errorf("---> TEST: Got x-request-id %v, expected a uuid", requestIds[0])
+	}
+	if requestIds[1] != "8e3c1d8a-4b36-4c5e-9d57-0f5d2a4c9b11" {
+		t.Errorf("---> TEST: Got x-request-id %v, expected the id of the context", requestIds[1])
+	}
+	log.Printf("---> TEST: x-request-ids: %v", requestIds)
+}
+
+func TestRetries(t *testing.T) {
+	var calls int32
+	var requestIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIds = append(requestIds, r.Header.Get("x-request-id"))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", `"7"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"key1":"value1"}`))
+	}))
+	defer srv.Close()
+
+	item, err := NewClient(srv.URL, fastRetry).Get(context.Background(), "key1")
+	if err != nil || item.Value != "value1" || item.ETag != `"7"` {
+		t.Errorf("---> TEST: Got %+v, %v, expected value1 after retries", item, err)
+	}
+	if calls != 3 || requestIds[0] != requestIds[2] {
+		t.Errorf("---> TEST: Got %v calls with ids %v, expected 3 calls with the same id", calls, requestIds)
+	}
+
+	// retries are exhausted, the last response is returned
+	atomic.StoreInt32(&calls, -10)
+	_, err = NewClient(srv.URL, fastRetry).Get(context.Background(), "key1")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusServiceUnavailable || calls != -7 {
+		t.Errorf("---> TEST: Got %v after %v calls, expected 503 after 3 calls", err, calls+10)
+	}
+	log.Printf("---> TEST: err: %v", err)
+}
+
+func TestRetryOfTimeouts(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}))
+	defer srv.Close()
+	c := NewClient(srv.URL, fastRetry)
+	ctx := context.Background()
+
+	// the operation may be executed after timeout, only calls giving the same result again are retried
+	tests := []struct {
+		name  string
+		call  func() error
+		calls int32
+	}{
+		{"Get", func() error { _, err := c.Get(ctx, "key1"); return err }, 3},
+		{"Set", func() error { _, err := c.Set(ctx, "key1", "x", SetOptions{Upsert: true}); return err }, 3},
+		{"Set If-Match", func() error { _, err := c.Set(ctx, "key1", "x", SetOptions{IfMatch: `"3"`}); return err }, 1},
+		{"Set If-None-Match", func() error { _, err := c.Set(ctx, "key1", "x", SetOptions{IfNoneMatch: "*"}); return err }, 1},
+		{"Delete", func() error { return c.Delete(ctx, "key1") }, 1},
+		{"DeleteAll", func() error { return c.DeleteAll(ctx) }, 1},
+		{"Increment", func() error { _, err := c.Increment(ctx, "counter", "1"); return err }, 1},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&calls, 0)
+		err := test.call()
+		if calls != test.calls || err == nil {
+			t.Errorf("---> TEST: %v got %v calls, expected %v. err: %v", test.name, calls, test.calls, err)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		err    error
+	}{
+		{http.StatusNotFound, "", ErrNotFound},
+		{http.StatusConflict, `{"key1":"current"}`, ErrConflict},
+		{http.StatusPreconditionFailed, "", ErrPreconditionFailed},
+		{http.StatusUnsupportedMediaType, "", ErrUnsupportedMediaType},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("x-request-id", r.Header.Get("x-request-id"))
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		expected := "expected"
+		_, err := NewClient(srv.URL, fastRetry).CompareAndSwap(context.Background(), "key1", &expected, "value1", 0)
+		srv.Close()
+
+		var e *Error
+		if !errors.Is(err, test.err) || !errors.As(err, &e) || e.RequestId == "" {
+			t.Errorf("---> TEST: Got %v, expected %v", err, test.err)
+		}
+		if test.status == http.StatusConflict && e.Current["key1"] != "current" {
+			t.Errorf("---> TEST: Got current %v, expected key1:current", e.Current)
+		}
+		log.Printf("---> TEST: err: %v", err)
+	}
+}
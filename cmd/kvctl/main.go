@@ -0,0 +1,405 @@
+// kvctl is the command line client of GOAPP, it calls the REST API of a server by goapp/client
+//
+//	kvctl [-server URL] [-output table|json] [-timeout 10s] <command> [flags] [args]
+//
+// Commands are get, set, delete, list, export, import, snapshot and stats, flags of a command are given before its args
+// Server is read from KVCTL_SERVER env if -server is not given. Exit codes are EXIT_* constants so scripts can tell
+// a missing key or a failed precondition from other failures
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"goapp/client"
+)
+
+const DEFAULT_SERVER = "http://localhost:8080"
+const DEFAULT_TIMEOUT = 10 * time.Second
+const LIST_PAGE_SIZE = 100 // keys asked per request while list walks the pages
+
+// Exit codes
+const (
+	EXIT_OK        = 0
+	EXIT_FAILED    = 1 // the server or the network failed
+	EXIT_USAGE     = 2 // unknown command, flag or missing argument
+	EXIT_NOT_FOUND = 3 // the key or the snapshot does not exist
+	EXIT_CONFLICT  = 4 // the key exists or a precondition failed
+)
+
+// Output modes
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+)
+
+const USAGE = `Usage: kvctl [-server URL] [-output table|json] [-timeout 10s] <command> [flags] [args]
+
+Commands:
+  get <key>                                     print the value of a key
+  set [-ttl 0] [-nx] [-xx] [-if-match ETAG] <key> <value>
+                                                write a key, -nx only if missing, -xx only if existing
+  delete <key>                                  delete a key
+  list [-prefix P] [-limit 0] [-values]         list keys in order, zero limit lists all
+  export [-prefix P] [-format ndjson|csv] [-o FILE]
+                                                write all pairs to FILE or stdout
+  import [-format ndjson|csv] [-mode merge|replace] [FILE]
+                                                read pairs from FILE or stdin
+  snapshot [-list] [-restore FILE]              write a snapshot now, list snapshots or restore one
+  stats                                         print counters of the server
+
+Exit codes: 0 ok, 1 failed, 2 usage, 3 not found, 4 conflict or precondition failed
+`
+
+// errUsage is returned by commands on wrong arguments, the usage is printed
+var errUsage = errors.New("wrong arguments")
+
+// cli holds the global options and the output streams of a run
+type cli struct {
+	c      *client.Client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes a command line and gives the exit code
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	server := os.Getenv("KVCTL_SERVER")
+	if server == "" {
+		server = DEFAULT_SERVER
+	}
+	flags := flag.NewFlagSet("kvctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, USAGE) }
+	flags.StringVar(&server, "server", server, "base URL of the server")
+	output := flags.String("output", OUTPUT_TABLE, "table or json")
+	timeout := flags.Duration("timeout", DEFAULT_TIMEOUT, "timeout of the command")
+	if err := flags.Parse(args); err != nil {
+		return EXIT_USAGE
+	}
+	if flags.NArg() == 0 || (*output != OUTPUT_TABLE && *output != OUTPUT_JSON) {
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	commands := map[string]func(*cli, context.Context, *flag.FlagSet, []string) error{
+		"get":      (*cli).get,
+		"set":      (*cli).set,
+		"delete":   (*cli).delete,
+		"list":     (*cli).list,
+		"export":   (*cli).export,
+		"import":   (*cli).importPairs,
+		"snapshot": (*cli).snapshot,
+		"stats":    (*cli).stats,
+	}
+	name := flags.Arg(0)
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "kvctl: unknown command %v\n", name)
+		flags.Usage()
+		return EXIT_USAGE
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	k := &cli{c: client.NewClient(server), output: *output, stdin: stdin, stdout: stdout}
+	commandFlags := flag.NewFlagSet("kvctl "+name, flag.ContinueOnError)
+	commandFlags.SetOutput(stderr)
+	commandFlags.Usage = func() { fmt.Fprint(stderr, USAGE) }
+	err := command(k, ctx, commandFlags, flags.Args()[1:])
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, errUsage):
+		commandFlags.Usage()
+		return EXIT_USAGE
+	case errors.Is(err, flag.ErrHelp):
+		return EXIT_USAGE
+	}
+	fmt.Fprintf(stderr, "kvctl: %v\n", err)
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		return EXIT_NOT_FOUND
+	case errors.Is(err, client.ErrConflict), errors.Is(err, client.ErrPreconditionFailed):
+		return EXIT_CONFLICT
+	}
+	return EXIT_FAILED
+}
+
+// parse parses the flags of a command and checks the number of its args
+func parse(flags *flag.FlagSet, args []string, minArgs int, maxArgs int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() < minArgs || flags.NArg() > maxArgs {
+		return errUsage
+	}
+	return nil
+}
+
+// print writes v as indented JSON in json mode, otherwise writes the rows as a table whose first row is the header
+func (k *cli) print(v interface{}, rows [][]string) error {
+	if k.output == OUTPUT_JSON {
+		encoder := json.NewEncoder(k.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(k.stdout, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// seconds formats a time to live, zero never expires
+func seconds(ttl time.Duration) string {
+	if ttl == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(int64(ttl/time.Second), 10)
+}
+
+func (k *cli) get(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	item, err := k.c.Get(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	v := map[string]interface{}{"key": item.Key, "value": item.Value, "etag": item.ETag, "ttl": int64(item.TTL / time.Second)}
+	return k.print(v, [][]string{{"KEY", "VALUE", "TTL", "ETAG"}, {item.Key, item.Value, seconds(item.TTL), item.ETag}})
+}
+
+func (k *cli) set(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	ttl := flags.Duration("ttl", 0, "time to live, zero never expires")
+	nx := flags.Bool("nx", false, "write only if the key does not exist")
+	xx := flags.Bool("xx", false, "write only if the key exists")
+	ifMatch := flags.String("if-match", "", "write only if the ETag of the current value matches")
+	if err := parse(flags, args, 2, 2); err != nil {
+		return err
+	}
+	if *nx && (*xx || *ifMatch != "") {
+		return errUsage
+	}
+	opts := client.SetOptions{TTL: *ttl, Upsert: !*xx && *ifMatch == "", IfMatch: *ifMatch}
+	if *nx {
+		opts.IfNoneMatch = "*"
+	}
+	created, err := k.c.Set(ctx, flags.Arg(0), flags.Arg(1), opts)
+	if err != nil {
+		return err
+	}
+	return k.print(map[string]interface{}{"key": flags.Arg(0), "created": created}, [][]string{{"KEY", "CREATED"}, {flags.Arg(0), strconv.FormatBool(created)}})
+}
+
+func (k *cli) delete(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	if err := k.c.Delete(ctx, flags.Arg(0)); err != nil {
+		return err
+	}
+	return k.print(map[string]interface{}{"key": flags.Arg(0), "deleted": true}, [][]string{{"KEY", "DELETED"}, {flags.Arg(0), "true"}})
+}
+
+func (k *cli) list(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	prefix := flags.String("prefix", "", "list keys with the prefix")
+	limit := flags.Int("limit", 0, "max number of keys, zero lists all")
+	values := flags.Bool("values", false, "list values too")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	} else if *limit < 0 {
+		return errUsage
+	}
+
+	// walk pages until the limit or the last page
+	result := client.ListResponse{Keys: []string{}}
+	if *values {
+		result.Pairs = make(map[string]string)
+	}
+	opts := client.ListOptions{Prefix: *prefix, Limit: LIST_PAGE_SIZE, Values: *values}
+	for {
+		if *limit > 0 && *limit-len(result.Keys) < opts.Limit {
+			opts.Limit = *limit - len(result.Keys)
+		}
+		page, err := k.c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		result.Keys = append(result.Keys, page.Keys...)
+		for key, value := range page.Pairs {
+			result.Pairs[key] = value
+		}
+		if page.Cursor == "" || len(result.Keys) == *limit {
+			result.Cursor = page.Cursor
+			break
+		}
+		opts.Cursor = page.Cursor
+	}
+
+	rows := [][]string{{"KEY"}}
+	if *values {
+		rows[0] = append(rows[0], "VALUE")
+	}
+	for _, key := range result.Keys {
+		if *values {
+			rows = append(rows, []string{key, result.Pairs[key]})
+		} else {
+			rows = append(rows, []string{key})
+		}
+	}
+	return k.print(result, rows)
+}
+
+// format gives the media type of ndjson or csv
+func format(name string) (string, error) {
+	switch name {
+	case "ndjson":
+		return client.FORMAT_NDJSON, nil
+	case "csv":
+		return client.FORMAT_CSV, nil
+	}
+	return "", errUsage
+}
+
+// export writes the stream as is, output mode does not apply
+func (k *cli) export(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	prefix := flags.String("prefix", "", "export keys with the prefix")
+	formatName := flags.String("format", "ndjson", "ndjson or csv")
+	file := flags.String("o", "", "output file, default is stdout")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	mediaType, err := format(*formatName)
+	if err != nil {
+		return err
+	}
+	stream, err := k.c.Export(ctx, *prefix, mediaType)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if *file == "" {
+		_, err = io.Copy(k.stdout, stream)
+	} else {
+		var f *os.File
+		if f, err = os.Create(*file); err != nil {
+			return err
+		}
+		_, err = io.Copy(f, stream)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("export is incomplete: %w", err)
+	}
+	return nil
+}
+
+func (k *cli) importPairs(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	formatName := flags.String("format", "ndjson", "ndjson or csv")
+	mode := flags.String("mode", client.IMPORT_MERGE, "merge or replace")
+	if err := parse(flags, args, 0, 1); err != nil {
+		return err
+	}
+	mediaType, err := format(*formatName)
+	if err != nil || (*mode != client.IMPORT_MERGE && *mode != client.IMPORT_REPLACE) {
+		return errUsage
+	}
+	in := k.stdin
+	if file := flags.Arg(0); file != "" && file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resp, err := k.c.Import(ctx, in, mediaType, *mode)
+	if err != nil {
+		return err
+	}
+	return k.print(resp, [][]string{{"IMPORTED", "SKIPPED", "INVALID", "DELETED"},
+		{strconv.Itoa(resp.Imported), strconv.Itoa(resp.Skipped), strconv.Itoa(resp.Invalid), strconv.Itoa(resp.Deleted)}})
+}
+
+func (k *cli) snapshot(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	list := flags.Bool("list", false, "list snapshot files, the latest is the first")
+	restore := flags.String("restore", "", "replace all keys with the pairs of a snapshot file")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	rows := [][]string{{"FILENAME", "SIZE", "TIME", "DELTAS"}}
+	switch {
+	case *list && *restore != "":
+		return errUsage
+	case *list:
+		infos, err := k.c.Snapshots(ctx)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			rows = append(rows, []string{info.Filename, strconv.FormatInt(info.Size, 10), info.Time.Format(time.RFC3339), strconv.Itoa(info.Deltas)})
+		}
+		return k.print(infos, rows)
+	case *restore != "":
+		keys, err := k.c.Restore(ctx, *restore)
+		if err != nil {
+			return err
+		}
+		return k.print(map[string]interface{}{"filename": *restore, "keys": keys}, [][]string{{"FILENAME", "KEYS"}, {*restore, strconv.Itoa(keys)}})
+	}
+	info, err := k.c.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	rows = append(rows, []string{info.Filename, strconv.FormatInt(info.Size, 10), info.Time.Format(time.RFC3339), strconv.Itoa(info.Deltas)})
+	return k.print(info, rows)
+}
+
+func (k *cli) stats(ctx context.Context, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	stats, err := k.c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	counters := map[string]string{
+		"keys":      strconv.Itoa(stats.Keys),
+		"expiring":  strconv.Itoa(stats.Expiring),
+		"bytes":     strconv.FormatInt(stats.Bytes, 10),
+		"version":   strconv.FormatUint(stats.Version, 10),
+		"shards":    strconv.Itoa(stats.Shards),
+		"snapshots": strconv.Itoa(stats.Snapshots),
+	}
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := [][]string{{"STAT", "VALUE"}}
+	for _, name := range names {
+		rows = append(rows, []string{name, counters[name]})
+	}
+	return k.print(stats, rows)
+}
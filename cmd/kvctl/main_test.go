@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeServer serves key1 and a list of three keys in pages of two, other keys are not found
+// If-None-Match: * fails since key1 exists
+func fakeServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/my/keys/key1":
+			w.Header().Set("ETag", `"3"`)
+			w.Header().Set("x-ttl", "60")
+			w.Write([]byte(`{"key1":"value1"}`))
+		case r.Method == "PUT" && r.Header.Get("If-None-Match") == "*":
+			w.WriteHeader(http.StatusPreconditionFailed)
+		case r.Method == "GET" && r.URL.Path == "/api/v1/my/keys" && r.URL.Query().Get("cursor") == "":
+			w.Write([]byte(`{"keys":["a","b"],"cursor":"Yg"}`))
+		case r.Method == "GET" && r.URL.Path == "/api/v1/my/keys":
+			w.Write([]byte(`{"keys":["c"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestExitCodes(t *testing.T) {
+	srv := fakeServer()
+	defer srv.Close()
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"get", "key1"}, EXIT_OK},
+		{[]string{"get", "missing"}, EXIT_NOT_FOUND},
+		{[]string{"set", "-nx", "key1", "value"}, EXIT_CONFLICT},
+		{[]string{"get"}, EXIT_USAGE},
+		{[]string{"unknown"}, EXIT_USAGE},
+		{[]string{"-output", "yaml", "get", "key1"}, EXIT_USAGE},
+		{[]string{"-server", "http://127.0.0.1:1", "-timeout", "100ms", "stats"}, EXIT_FAILED},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-server", srv.URL}, test.args...)
+		if code := run(args, nil, &stdout, &stderr); code != test.code {
+			t.Errorf("---> TEST: %v got exit code %v, expected %v. stderr: %v", test.args, code, test.code, stderr.String())
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	srv := fakeServer()
+	defer srv.Close()
+
+	var stdout bytes.Buffer
+	run([]string{"-server", srv.URL, "get", "key1"}, nil, &stdout, &stdout)
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != `key1 value1 60 "3"` {
+		t.Errorf("---> TEST: Table got %q", stdout.String())
+	}
+
+	stdout.Reset()
+	run([]string{"-server", srv.URL, "-output", "json", "get", "key1"}, nil, &stdout, &stdout)
+	var item map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &item); err != nil || item["value"] != "value1" || item["ttl"] != 60.0 {
+		t.Errorf("---> TEST: JSON got %q", stdout.String())
+	}
+
+	// list walks all pages
+	stdout.Reset()
+	run([]string{"-server", srv.URL, "-output", "json", "list"}, nil, &stdout, &stdout)
+	var page struct{ Keys []string }
+	if err := json.Unmarshal(stdout.Bytes(), &page); err != nil || strings.Join(page.Keys, ",") != "a,b,c" {
+		t.Errorf("---> TEST: List got %q", stdout.String())
+	}
+	log.Printf("---> TEST: list: %v", page.Keys)
+}
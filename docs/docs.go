@@ -23,7 +23,175 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/my/export": {
+            "get": {
+                "description": "export all pairs as NDJSON or CSV",
+                "produces": [
+                    "application/x-ndjson",
+                    "text/csv"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Export pairs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key prefix",
+                        "name": "prefix",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ExportRecord"
+                            }
+                        }
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        },
+        "/my/import": {
+            "post": {
+                "description": "import pairs from NDJSON or CSV",
+                "consumes": [
+                    "application/x-ndjson",
+                    "text/csv"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Import pairs",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "merge (default) or replace",
+                        "name": "mode",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Records",
+                        "name": "records",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/main.ExportRecord"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ImportResponse"
+                        }
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        },
         "/my/keys": {
+            "get": {
+                "description": "list keys",
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "List keys",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key prefix",
+                        "name": "prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "page size, default 100, max 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "cursor of the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "include values",
+                        "name": "values",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.ListResponse"
+                        }
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            },
             "post": {
                 "description": "create",
                 "consumes": [
@@ -32,11 +200,11 @@ var doc = `{
                 "tags": [
                     "GoApp"
                 ],
-                "summary": "Create a new pair or update existing",
+                "summary": "Create new pairs",
                 "parameters": [
                     {
-                        "description": "Pair",
-                        "name": "pair",
+                        "description": "Pairs",
+                        "name": "pairs",
                         "in": "body",
                         "required": true,
                         "schema": {
@@ -45,10 +213,31 @@ var doc = `{
                                 "type": "string"
                             }
                         }
+                    },
+                    {
+                        "type": "integer",
+                        "description": "time to live in seconds",
+                        "name": "x-ttl",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "*",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "201": {
+                        "description": "Created",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
                         "description": ""
                     },
                     "404": {
@@ -57,11 +246,29 @@ var doc = `{
                     "405": {
                         "description": ""
                     },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "412": {
+                        "description": ""
+                    },
                     "415": {
                         "description": ""
                     },
                     "500": {
                         "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
                     }
                 }
             },
@@ -86,6 +293,12 @@ var doc = `{
                     },
                     "500": {
                         "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
                     }
                 }
             }
@@ -104,6 +317,12 @@ var doc = `{
                         "name": "key",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached value",
+                        "name": "If-None-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -111,8 +330,21 @@ var doc = `{
                         "description": "OK",
                         "schema": {
                             "type": "string"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "version of the value"
+                            },
+                            "x-ttl": {
+                                "type": "integer",
+                                "description": "remaining time to live in seconds"
+                            }
                         }
                     },
+                    "304": {
+                        "description": ""
+                    },
                     "404": {
                         "description": ""
                     },
@@ -124,6 +356,431 @@ var doc = `{
                     },
                     "500": {
                         "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            },
+            "put": {
+                "description": "update",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Update existing pair",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "create the key if it does not exist",
+                        "name": "upsert",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "time to live in seconds",
+                        "name": "x-ttl",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of the current value",
+                        "name": "If-Match",
+                        "in": "header"
+                    },
+                    {
+                        "type": "string",
+                        "description": "*",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Pair",
+                        "name": "pair",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": ""
+                    },
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "412": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            },
+            "delete": {
+                "description": "delete pair",
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Delete pair",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        },
+        "/my/keys/{key}/cad": {
+            "post": {
+                "description": "compare and delete",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Compare and delete",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Expected value",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CompareAndDeleteRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": ""
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        },
+        "/my/keys/{key}/cas": {
+            "post": {
+                "description": "compare and swap",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Compare and swap",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "time to live in seconds",
+                        "name": "x-ttl",
+                        "in": "header"
+                    },
+                    {
+                        "description": "Expected and new value",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.CompareAndSwapRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        },
+        "/my/keys/{key}/{op}": {
+            "post": {
+                "description": "increment or decrement",
+                "consumes": [
+                    "application/json"
+                ],
+                "tags": [
+                    "GoApp"
+                ],
+                "summary": "Increment or decrement",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "key",
+                        "name": "key",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "incr or decr",
+                        "name": "op",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Delta",
+                        "name": "request",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/main.IncrementRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": ""
+                    },
+                    "404": {
+                        "description": ""
+                    },
+                    "405": {
+                        "description": ""
+                    },
+                    "415": {
+                        "description": ""
+                    },
+                    "422": {
+                        "description": ""
+                    },
+                    "500": {
+                        "description": ""
+                    },
+                    "503": {
+                        "description": ""
+                    },
+                    "504": {
+                        "description": ""
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "main.CompareAndDeleteRequest": {
+            "type": "object",
+            "properties": {
+                "expected": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.CompareAndSwapRequest": {
+            "type": "object",
+            "properties": {
+                "expected": {
+                    "type": "string"
+                },
+                "value": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ExportRecord": {
+            "type": "object",
+            "properties": {
+                "key": {
+                    "type": "string"
+                },
+                "ttl": {
+                    "type": "integer"
+                },
+                "value": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.ImportResponse": {
+            "type": "object",
+            "properties": {
+                "deleted": {
+                    "type": "integer"
+                },
+                "imported": {
+                    "type": "integer"
+                },
+                "invalid": {
+                    "type": "integer"
+                },
+                "skipped": {
+                    "type": "integer"
+                }
+            }
+        },
+        "main.IncrementRequest": {
+            "type": "object",
+            "properties": {
+                "delta": {
+                    "type": "number"
+                }
+            }
+        },
+        "main.ListResponse": {
+            "type": "object",
+            "properties": {
+                "cursor": {
+                    "type": "string"
+                },
+                "keys": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "pairs": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
                     }
                 }
             }
@@ -0,0 +1,867 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TODO: merge underfull nodes on delete, today they are only removed when empty and compaction rebuilds the tree
+
+const BTREE_PAGE_SIZE = 4096     // nodes are written at page boundaries, a node larger than a page takes contiguous pages
+const BTREE_MAGIC = "GOKVBT02"   // first bytes of a meta page
+const btreeMagicV1 = "GOKVBT01"  // meta page without version counter, written by older versions
+const BTREE_COMPACT_SLACK = 256  // pages, file is compacted when it has more than twice its live pages plus slack
+const btreeMaxNodeSize = 1 << 30 // a node length over this limit is a corrupted header
+
+// Node types
+const (
+	btreeLeaf   = 1
+	btreeBranch = 2
+)
+
+// BTreeFile is a copy-on-write B+tree in a single file, in the spirit of bolt
+// Pages 0 and 1 are meta pages written alternately, each commit writes modified nodes to new pages at the end of the file,
+// syncs, then writes the meta page pointing to the new root and syncs again
+// A crash before the meta page is written leaves the previous tree intact, a torn meta page is detected by its checksum
+// Pages of replaced nodes are not reused, the file is compacted by rewriting the whole tree
+// It is not safe for concurrent use
+type BTreeFile struct {
+	path string
+	file *os.File
+	meta btreeMeta
+}
+
+// btreeMeta is the content of a meta page, root zero is an empty tree
+// pages is the number of pages in the file, live is the number of pages reachable from root
+// version is the version counter of Store at the commit
+type btreeMeta struct {
+	txid     uint64
+	root     uint64
+	pages    uint64
+	live     uint64
+	keys     uint64
+	time     int64 // unix milliseconds of the commit
+	version  uint64
+	checksum uint32
+}
+
+// btreeNode is a leaf with keys and entries, or a branch with keys and children
+// keys[i] of a branch is the lower bound of the keys in children[i]
+type btreeNode struct {
+	leaf     bool
+	keys     []string
+	entries  []Entry
+	children []btreeRef
+	pages    uint64 // pages the node takes in the file, zero for a node not written yet
+}
+
+// btreeRef refers a node by page id, node is set when the node is read and modified in a transaction
+type btreeRef struct {
+	id   uint64
+	node *btreeNode
+}
+
+// btreeTx collects changes on a copy of the modified paths, Commit writes them to the file
+// version is written into the meta page, it is the version of the previous commit unless it is set
+type btreeTx struct {
+	f       *BTreeFile
+	root    btreeRef
+	next    uint64 // next free page
+	keys    uint64
+	freed   uint64 // pages of replaced nodes
+	written uint64 // pages of written nodes
+	version uint64
+}
+
+// OpenBTreeFile opens or creates a b-tree file, the latest valid meta page is used
+func OpenBTreeFile(path string) (*BTreeFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	f := &BTreeFile{path: path, file: file}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		// a new file has two empty meta pages
+		f.meta = btreeMeta{pages: 2}
+		for id := uint64(0); id < 2; id++ {
+			if _, err := file.WriteAt(f.meta.encode(), int64(id*BTREE_PAGE_SIZE)); err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	metas := f.metas()
+	if len(metas) == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%v has no valid meta page", path)
+	}
+	f.meta = metas[0]
+	return f, nil
+}
+
+// metas reads valid meta pages, the latest is the first
+func (f *BTreeFile) metas() []btreeMeta {
+	var metas []btreeMeta
+	buf := make([]byte, BTREE_PAGE_SIZE)
+	for id := int64(0); id < 2; id++ {
+		if _, err := f.file.ReadAt(buf, id*BTREE_PAGE_SIZE); err != nil && err != io.EOF {
+			continue
+		}
+		if meta, err := decodeBTreeMeta(buf); err == nil {
+			metas = append(metas, meta)
+		} else {
+			log.Printf("WARNING Invalid meta page %v of %v. err:%v\r\n", id, f.path, err)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].txid > metas[j].txid })
+	return metas
+}
+
+// Close closes the file
+func (f *BTreeFile) Close() error {
+	return f.file.Close()
+}
+
+// Entries reads all entries of the tree
+func (f *BTreeFile) Entries() (map[string]Entry, error) {
+	dict := make(map[string]Entry, f.meta.keys)
+	err := f.walk(f.meta.root, func(key string, e Entry) {
+		dict[key] = e
+	})
+	return dict, err
+}
+
+// walk calls fn for each entry under the node in key order
+func (f *BTreeFile) walk(id uint64, fn func(key string, e Entry)) error {
+	if id == 0 {
+		return nil
+	}
+	n, err := f.read(id)
+	if err != nil {
+		return err
+	}
+	if n.leaf {
+		for i, key := range n.keys {
+			fn(key, n.entries[i])
+		}
+		return nil
+	}
+	for _, child := range n.children {
+		if err := f.walk(child.id, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads and verifies the node at given page
+func (f *BTreeFile) read(id uint64) (*btreeNode, error) {
+	if id < 2 || id >= f.meta.pages {
+		return nil, fmt.Errorf("page %v is out of file", id)
+	}
+	head := make([]byte, 8)
+	if _, err := f.file.ReadAt(head, int64(id*BTREE_PAGE_SIZE)); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(head[4:])
+	if length > btreeMaxNodeSize {
+		return nil, fmt.Errorf("page %v has invalid length %v", id, length)
+	}
+	buf := make([]byte, length)
+	if _, err := f.file.ReadAt(buf, int64(id*BTREE_PAGE_SIZE)+8); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.LittleEndian.Uint32(head) {
+		return nil, fmt.Errorf("checksum mismatch on page %v", id)
+	}
+	n, err := decodeBTreeNode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode page %v: %v", id, err)
+	}
+	n.pages = (8 + uint64(length) + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE
+	return n, nil
+}
+
+// Begin starts a transaction on the current tree
+func (f *BTreeFile) Begin() *btreeTx {
+	return &btreeTx{f: f, root: btreeRef{id: f.meta.root}, next: f.meta.pages, keys: f.meta.keys, version: f.meta.version}
+}
+
+// mutable gives the modifiable copy of a node, a node read from the file is replaced at commit
+func (t *btreeTx) mutable(ref *btreeRef) (*btreeNode, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	n, err := t.f.read(ref.id)
+	if err != nil {
+		return nil, err
+	}
+	t.freed += n.pages
+	ref.node = n
+	return n, nil
+}
+
+// Put writes an entry
+func (t *btreeTx) Put(key string, e Entry) error {
+	if t.root.id == 0 && t.root.node == nil {
+		t.root.node = &btreeNode{leaf: true}
+	}
+	root, err := t.mutable(&t.root)
+	if err != nil {
+		return err
+	}
+	if err := t.put(root, key, e); err != nil {
+		return err
+	}
+	// a root too large is split under a new root
+	for parts := splitBTreeNode(root); len(parts) > 1; parts = splitBTreeNode(root) {
+		root = &btreeNode{}
+		for _, part := range parts {
+			root.keys = append(root.keys, part.keys[0])
+			root.children = append(root.children, btreeRef{node: part})
+		}
+		t.root = btreeRef{node: root}
+	}
+	return nil
+}
+
+func (t *btreeTx) put(n *btreeNode, key string, e Entry) error {
+	i := sort.SearchStrings(n.keys, key)
+	if n.leaf {
+		if i < len(n.keys) && n.keys[i] == key {
+			n.entries[i] = e
+			return nil
+		}
+		n.keys = append(n.keys, "")
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		n.entries = append(n.entries, Entry{})
+		copy(n.entries[i+1:], n.entries[i:])
+		n.entries[i] = e
+		t.keys++
+		return nil
+	}
+
+	// the child is the last one with a lower bound not greater than key, the first child takes smaller keys
+	c := i
+	if c == len(n.keys) || n.keys[c] != key {
+		c--
+	}
+	if c < 0 {
+		c = 0
+		n.keys[0] = key
+	}
+	child, err := t.mutable(&n.children[c])
+	if err != nil {
+		return err
+	}
+	if err := t.put(child, key, e); err != nil {
+		return err
+	}
+	if parts := splitBTreeNode(child); len(parts) > 1 {
+		keys := make([]string, 0, len(n.keys)+len(parts)-1)
+		children := make([]btreeRef, 0, len(n.children)+len(parts)-1)
+		keys = append(keys, n.keys[:c]...)
+		children = append(children, n.children[:c]...)
+		for _, part := range parts {
+			keys = append(keys, part.keys[0])
+			children = append(children, btreeRef{node: part})
+		}
+		n.keys = append(keys, n.keys[c+1:]...)
+		n.children = append(children, n.children[c+1:]...)
+	}
+	return nil
+}
+
+// Delete removes an entry, returns false if the key does not exist
+func (t *btreeTx) Delete(key string) (bool, error) {
+	if t.root.id == 0 && t.root.node == nil {
+		return false, nil
+	}
+	root, err := t.mutable(&t.root)
+	if err != nil {
+		return false, err
+	}
+	found, err := t.delete(root, key)
+	if err != nil {
+		return false, err
+	}
+	// a root with a single child is replaced by the child, an empty root leaves an empty tree
+	for !root.leaf && len(root.children) == 1 {
+		t.root = root.children[0]
+		if t.root.node == nil {
+			return found, nil
+		}
+		root = t.root.node
+	}
+	if len(root.keys) == 0 {
+		t.root = btreeRef{}
+	}
+	return found, nil
+}
+
+func (t *btreeTx) delete(n *btreeNode, key string) (bool, error) {
+	i := sort.SearchStrings(n.keys, key)
+	if n.leaf {
+		if i == len(n.keys) || n.keys[i] != key {
+			return false, nil
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.entries = append(n.entries[:i], n.entries[i+1:]...)
+		t.keys--
+		return true, nil
+	}
+
+	c := i
+	if c == len(n.keys) || n.keys[c] != key {
+		c--
+	}
+	if c < 0 {
+		return false, nil
+	}
+	child, err := t.mutable(&n.children[c])
+	if err != nil {
+		return false, err
+	}
+	found, err := t.delete(child, key)
+	if err != nil {
+		return false, err
+	}
+	if len(child.keys) == 0 {
+		n.keys = append(n.keys[:c], n.keys[c+1:]...)
+		n.children = append(n.children[:c], n.children[c+1:]...)
+	}
+	return found, nil
+}
+
+// Commit writes modified nodes and the new meta page, the file is synced before and after the meta page
+func (t *btreeTx) Commit() (btreeMeta, error) {
+	root, err := t.write(&t.root)
+	if err != nil {
+		return t.f.meta, err
+	}
+	if err := t.f.file.Sync(); err != nil {
+		return t.f.meta, err
+	}
+	meta := btreeMeta{
+		txid:    t.f.meta.txid + 1,
+		root:    root,
+		pages:   t.next,
+		live:    t.f.meta.live + t.written - t.freed,
+		keys:    t.keys,
+		time:    time.Now().UnixMilli(),
+		version: t.version,
+	}
+	buf := meta.encode()
+	if _, err := t.f.file.WriteAt(buf, int64(meta.txid%2)*BTREE_PAGE_SIZE); err != nil {
+		return t.f.meta, err
+	}
+	if err := t.f.file.Sync(); err != nil {
+		return t.f.meta, err
+	}
+	meta, _ = decodeBTreeMeta(buf)
+	t.f.meta = meta
+	return meta, nil
+}
+
+// write writes a modified node after its modified children, returns the page id of the node
+func (t *btreeTx) write(ref *btreeRef) (uint64, error) {
+	if ref.node == nil {
+		return ref.id, nil
+	}
+	n := ref.node
+	if !n.leaf {
+		for i := range n.children {
+			id, err := t.write(&n.children[i])
+			if err != nil {
+				return 0, err
+			}
+			n.children[i] = btreeRef{id: id}
+		}
+	}
+	buf := n.encode()
+	pages := (uint64(len(buf)) + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE
+	id := t.next
+	if _, err := t.f.file.WriteAt(buf, int64(id*BTREE_PAGE_SIZE)); err != nil {
+		return 0, err
+	}
+	t.next += pages
+	t.written += pages
+	*ref = btreeRef{id: id}
+	return id, nil
+}
+
+// splitBTreeNode splits a node larger than a page into halves by size, a single element is never split
+func splitBTreeNode(n *btreeNode) []*btreeNode {
+	if len(n.keys) < 2 || len(n.encode()) <= BTREE_PAGE_SIZE {
+		return []*btreeNode{n}
+	}
+	sizes := make([]int, len(n.keys))
+	total := 0
+	for i := range n.keys {
+		sizes[i] = len(n.appendElement(nil, i))
+		total += sizes[i]
+	}
+	m, sum := 1, sizes[0]
+	for m < len(n.keys)-1 && sum+sizes[m] <= total/2 {
+		sum += sizes[m]
+		m++
+	}
+	left := &btreeNode{leaf: n.leaf, keys: append([]string(nil), n.keys[:m]...)}
+	right := &btreeNode{leaf: n.leaf, keys: append([]string(nil), n.keys[m:]...)}
+	if n.leaf {
+		left.entries = append([]Entry(nil), n.entries[:m]...)
+		right.entries = append([]Entry(nil), n.entries[m:]...)
+	} else {
+		left.children = append([]btreeRef(nil), n.children[:m]...)
+		right.children = append([]btreeRef(nil), n.children[m:]...)
+	}
+	return append(splitBTreeNode(left), splitBTreeNode(right)...)
+}
+
+// encode gives the node with its header: crc32 and length of the rest
+func (n *btreeNode) encode() []byte {
+	buf := make([]byte, 8, BTREE_PAGE_SIZE)
+	if n.leaf {
+		buf = append(buf, btreeLeaf)
+	} else {
+		buf = append(buf, btreeBranch)
+	}
+	buf = appendUvarint(buf, uint64(len(n.keys)))
+	for i := range n.keys {
+		buf = n.appendElement(buf, i)
+	}
+	binary.LittleEndian.PutUint32(buf[0:], crc32.ChecksumIEEE(buf[8:]))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+	return buf
+}
+
+// appendElement appends key and entry of a leaf, key and child page of a branch
+func (n *btreeNode) appendElement(buf []byte, i int) []byte {
+	buf = appendUvarint(buf, uint64(len(n.keys[i])))
+	buf = append(buf, n.keys[i]...)
+	if n.leaf {
+		e := n.entries[i]
+		buf = appendUvarint(buf, uint64(len(e.Value)))
+		buf = append(buf, e.Value...)
+		var tmp [binary.MaxVarintLen64]byte
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], e.ExpiresAt)]...)
+		return appendUvarint(buf, e.Version)
+	}
+	return appendUvarint(buf, n.children[i].id)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// decodeBTreeNode decodes a node without its header
+func decodeBTreeNode(buf []byte) (*btreeNode, error) {
+	r := bytes.NewReader(buf)
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if typ != btreeLeaf && typ != btreeBranch {
+		return nil, fmt.Errorf("unknown node type %v", typ)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(buf)) {
+		return nil, errors.New("invalid element count")
+	}
+	n := &btreeNode{leaf: typ == btreeLeaf, keys: make([]string, 0, count)}
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, key)
+		if n.leaf {
+			var e Entry
+			if e.Value, err = readString(r); err != nil {
+				return nil, err
+			}
+			if e.ExpiresAt, err = binary.ReadVarint(r); err != nil {
+				return nil, err
+			}
+			if e.Version, err = binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+			n.entries = append(n.entries, e)
+		} else {
+			id, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, btreeRef{id: id})
+		}
+	}
+	return n, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// encode gives a meta page
+func (m btreeMeta) encode() []byte {
+	buf := make([]byte, BTREE_PAGE_SIZE)
+	copy(buf, BTREE_MAGIC)
+	binary.LittleEndian.PutUint64(buf[8:], m.txid)
+	binary.LittleEndian.PutUint64(buf[16:], m.root)
+	binary.LittleEndian.PutUint64(buf[24:], m.pages)
+	binary.LittleEndian.PutUint64(buf[32:], m.live)
+	binary.LittleEndian.PutUint64(buf[40:], m.keys)
+	binary.LittleEndian.PutUint64(buf[48:], uint64(m.time))
+	binary.LittleEndian.PutUint64(buf[56:], m.version)
+	binary.LittleEndian.PutUint32(buf[64:], crc32.ChecksumIEEE(buf[:64]))
+	return buf
+}
+
+// decodeBTreeMeta decodes and verifies a meta page, a meta page of older versions has no version counter
+func decodeBTreeMeta(buf []byte) (btreeMeta, error) {
+	var m btreeMeta
+	if len(buf) < 68 || (string(buf[:8]) != BTREE_MAGIC && string(buf[:8]) != btreeMagicV1) {
+		return m, errors.New("not a b-tree meta page")
+	}
+	end := 64
+	if string(buf[:8]) == btreeMagicV1 {
+		end = 56
+	} else {
+		m.version = binary.LittleEndian.Uint64(buf[56:])
+	}
+	m.checksum = binary.LittleEndian.Uint32(buf[end:])
+	if crc32.ChecksumIEEE(buf[:end]) != m.checksum {
+		return m, errors.New("checksum mismatch")
+	}
+	m.txid = binary.LittleEndian.Uint64(buf[8:])
+	m.root = binary.LittleEndian.Uint64(buf[16:])
+	m.pages = binary.LittleEndian.Uint64(buf[24:])
+	m.live = binary.LittleEndian.Uint64(buf[32:])
+	m.keys = binary.LittleEndian.Uint64(buf[40:])
+	m.time = int64(binary.LittleEndian.Uint64(buf[48:]))
+	return m, nil
+}
+
+// BTreePersistance persists the dict into a BTreeFile <prefix>.db in data directory
+// Only the keys changed since the previous commit are written, changes are found by comparing entries with the tree
+// Retention config is not used, the file holds the latest commit and the previous one as fallback
+// A delta sent by Store is committed without comparing, needFull is set when a commit fails and the next persist compares the whole dict
+// version is the version counter of the latest request, it is written into the meta page of each commit
+type BTreePersistance struct {
+	persistLoop
+	mu       sync.Mutex // ListSnapshots and ReadSnapshot are called by the callers of Store
+	config   PersistanceConfig
+	db       *BTreeFile
+	needFull bool
+	version  uint64
+}
+
+// NewBTreePersistance opens or creates the b-tree file and starts the timer
+func NewBTreePersistance(interval int, config PersistanceConfig) (*BTreePersistance, error) {
+	if err := os.MkdirAll(config.Dir, 0750); err != nil {
+		log.Printf("ERROR Cannot create data directory %v. err:%v\r\n", config.Dir, err)
+	}
+	db, err := OpenBTreeFile(filepath.Join(config.Dir, config.Prefix+".db"))
+	if err != nil {
+		return nil, err
+	}
+	p := &BTreePersistance{config: config, db: db}
+	p.StartTicker(interval)
+	return p, nil
+}
+
+// StartTicker starts the timer and listener
+func (p *BTreePersistance) StartTicker(interval int) {
+	p.start(interval, p.persistRequest)
+}
+
+// persistRequest commits the delta of the request if it is given, otherwise compares the whole dict
+func (p *BTreePersistance) persistRequest(req PersistRequest) SnapshotInfo {
+	p.mu.Lock()
+	if req.version > p.version {
+		p.version = req.version
+	}
+	p.mu.Unlock()
+	if req.delta != nil && !req.force && !p.needFull {
+		return p.persistDelta(req)
+	}
+	dict := req.Dict()
+	return p.persist(&dict, req.force)
+}
+
+// persistDelta writes entries and deletes keys of the delta in one commit, the whole dict is used only for compaction
+func (p *BTreePersistance) persistDelta(req PersistRequest) SnapshotInfo {
+	delta := req.delta
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]string, 0, len(delta.Entries))
+	for k := range delta.Entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tx := p.db.Begin()
+	tx.version = p.version
+	var err error
+	for _, k := range keys {
+		if err = tx.Put(k, delta.Entries[k]); err != nil {
+			break
+		}
+	}
+	for _, k := range delta.Deleted {
+		if err != nil {
+			break
+		}
+		_, err = tx.Delete(k)
+	}
+	var meta btreeMeta
+	if err == nil {
+		meta, err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("ERROR Cannot commit delta into %v. err:%v\r\n", p.db.path, err)
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	log.Printf("INFO delta (%v keys written, %v deleted) persisted into %v, txid:%v", len(keys), len(delta.Deleted), p.db.path, meta.txid)
+
+	if meta.pages > 2*meta.live+BTREE_COMPACT_SLACK {
+		dict := req.Dict()
+		keys = make([]string, 0, len(dict))
+		for k := range dict {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if err := p.compact(keys, dict); err != nil {
+			log.Printf("ERROR Compaction of %v failed, current file is kept. err:%v\r\n", p.db.path, err)
+		}
+	}
+	return p.info()
+}
+
+// Persist writes changed keys into the b-tree file
+func (p *BTreePersistance) Persist(dict *map[string]Entry) string {
+	return p.persist(dict, false).Filename
+}
+
+// persist writes changed keys and deletes missing keys in one commit, nothing is written when there is no change unless forced
+func (p *BTreePersistance) persist(dict *map[string]Entry, force bool) SnapshotInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, err := p.db.Entries()
+	if err != nil {
+		log.Printf("ERROR Cannot read %v. err:%v\r\n", p.db.path, err)
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	keys := make([]string, 0, len(*dict))
+	for k := range *dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	deleted := make([]string, 0)
+	for k := range old {
+		if _, ok := (*dict)[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+	sort.Strings(deleted)
+
+	tx := p.db.Begin()
+	tx.version = p.version
+	changes := len(deleted)
+	for _, k := range keys {
+		if e, ok := old[k]; !ok || e != (*dict)[k] {
+			if err = tx.Put(k, (*dict)[k]); err != nil {
+				break
+			}
+			changes++
+		}
+	}
+	for _, k := range deleted {
+		if err != nil {
+			break
+		}
+		_, err = tx.Delete(k)
+	}
+	if err != nil {
+		log.Printf("ERROR Cannot update %v. err:%v\r\n", p.db.path, err)
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	if changes == 0 && !force {
+		p.needFull = false
+		return SnapshotInfo{}
+	}
+	meta, err := tx.Commit()
+	if err != nil {
+		log.Printf("ERROR Commit failed on %v. err:%v\r\n", p.db.path, err)
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	p.needFull = false
+	log.Printf("INFO dict (%v changes) persisted into %v, txid:%v", changes, p.db.path, meta.txid)
+
+	if meta.pages > 2*meta.live+BTREE_COMPACT_SLACK {
+		if err := p.compact(keys, *dict); err != nil {
+			log.Printf("ERROR Compaction of %v failed, current file is kept. err:%v\r\n", p.db.path, err)
+		}
+	}
+	return p.info()
+}
+
+// compact rewrites the tree into a new file and replaces the current file
+// The new file is reopened before it replaces the current file, the current file and its handle are kept if anything fails
+func (p *BTreePersistance) compact(keys []string, dict map[string]Entry) error {
+	tmp := p.db.path + ".compact"
+	os.Remove(tmp)
+	db, err := OpenBTreeFile(tmp)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	tx.version = p.version
+	for _, k := range keys {
+		if err = tx.Put(k, dict[k]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = tx.Commit()
+	}
+	if err2 := db.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		// reading the meta pages again checks the written file before it replaces the current file
+		db, err = OpenBTreeFile(tmp)
+		if err == nil {
+			if err = os.Rename(tmp, p.db.path); err != nil {
+				db.Close()
+			}
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if d, err := os.Open(p.config.Dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	p.db.Close()
+	db.path = p.db.path
+	p.db = db
+	log.Printf("INFO Compacted %v, pages:%v", p.db.path, p.db.meta.pages)
+	return nil
+}
+
+// info describes the latest commit
+func (p *BTreePersistance) info() SnapshotInfo {
+	info := SnapshotInfo{Filename: p.db.path, Hash: fmt.Sprintf("%08x", p.db.meta.checksum), Time: time.UnixMilli(p.db.meta.time)}
+	if stat, err := p.db.file.Stat(); err == nil {
+		info.Size = stat.Size()
+	}
+	return info
+}
+
+// ListSnapshots gives the latest commit, the list is empty if nothing is committed yet
+func (p *BTreePersistance) ListSnapshots() ([]SnapshotInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db.meta.txid == 0 {
+		return []SnapshotInfo{}, nil
+	}
+	return []SnapshotInfo{p.info()}, nil
+}
+
+// ReadSnapshot reads the latest commit, name is the b-tree file
+func (p *BTreePersistance) ReadSnapshot(name string) (map[string]Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if filepath.Base(name) != filepath.Base(p.db.path) || p.db.meta.txid == 0 {
+		return nil, os.ErrNotExist
+	}
+	return p.db.Entries()
+}
+
+// RestoreFromPersistance reads the latest commit, falls back to the previous commit if the latest tree is corrupted
+func (p *BTreePersistance) RestoreFromPersistance() (map[string]Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db.meta.txid == 0 {
+		log.Printf("INFO Cannot find any commit in %v.", p.db.path)
+		return nil, fmt.Errorf("cannot find any commit in %v", p.db.path)
+	}
+
+	for _, meta := range p.db.metas() {
+		if meta.txid == 0 {
+			continue
+		}
+		p.db.meta = meta
+		dict, err := p.db.Entries()
+		if err != nil {
+			log.Printf("ERROR Cannot restore txid %v of %v, trying the previous commit. err:%v", meta.txid, p.db.path, err)
+			continue
+		}
+
+		// entries expired while the application was down are dropped
+		now := time.Now()
+		for k, e := range dict {
+			if e.Expired(now) {
+				delete(dict, k)
+			}
+		}
+		log.Printf("DEBUG restored %v txid:%v dict.size: %v version: %v", p.db.path, meta.txid, len(dict), meta.version)
+		p.version = meta.version
+		return dict, nil
+	}
+	// next commits write a new tree after the corrupted ones
+	if metas := p.db.metas(); len(metas) > 0 {
+		p.db.meta = btreeMeta{txid: metas[0].txid, pages: metas[0].pages}
+	}
+	log.Printf("ERROR All commits in %v are corrupted.", p.db.path)
+	return nil, fmt.Errorf("all commits in %v are corrupted", p.db.path)
+}
+
+// Version gives the version counter of the latest restored or persisted commit
+func (p *BTreePersistance) Version() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
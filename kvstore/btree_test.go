@@ -0,0 +1,184 @@
+package kvstore
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBTreeFileRandomOperations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "RANDOM.db")
+	db, err := OpenBTreeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]Entry)
+	random := rand.New(rand.NewSource(1))
+	for commit := 0; commit < 20; commit++ {
+		tx := db.Begin()
+		for i := 0; i < 500; i++ {
+			key := "key" + strconv.Itoa(random.Intn(2000))
+			if random.Intn(3) == 0 {
+				found, err := tx.Delete(key)
+				if _, ok := expected[key]; err != nil || ok != found {
+					t.Fatalf("---> TEST: Delete %v got %v, err:%v", key, found, err)
+				}
+				delete(expected, key)
+			} else {
+				// some values take more than a page
+				e := Entry{Value: strings.Repeat("v", random.Intn(50)*random.Intn(200)), Version: uint64(commit*1000 + i)}
+				if err := tx.Put(key, e); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = e
+			}
+		}
+		if _, err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = OpenBTreeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dict, err := db.Entries()
+	if err != nil || len(dict) != len(expected) || db.meta.keys != uint64(len(expected)) {
+		t.Fatalf("---> TEST: Got %v entries, %v keys in meta, expected %v. err:%v", len(dict), db.meta.keys, len(expected), err)
+	}
+	for k, e := range expected {
+		if dict[k] != e {
+			t.Fatalf("---> TEST: Got %v for %v, expected %v", dict[k], k, e)
+		}
+	}
+}
+
+func TestBTreePersistanceWritesOnlyChanges(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "BTREE", Backend: BACKEND_BTREE}
+	p, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := make(map[string]Entry)
+	for i := 0; i < 5000; i++ {
+		dict["key"+strconv.Itoa(i)] = Entry{Value: "value" + strconv.Itoa(i), Version: uint64(i)}
+	}
+	if p.Persist(&dict) == "" {
+		t.Fatal("---> TEST: Persist failed")
+	}
+	if p.Persist(&dict) != "" {
+		t.Error("---> TEST: Unchanged dict must not be persisted")
+	}
+
+	// a single change writes only the path to its leaf
+	pages := p.db.meta.pages
+	dict["key42"] = Entry{Value: "changed", Version: 5001}
+	delete(dict, "key4242")
+	p.Persist(&dict)
+	if written := p.db.meta.pages - pages; written > 8 {
+		t.Errorf("---> TEST: Got %v pages written for two changes", written)
+	}
+
+	restored, err := p.RestoreFromPersistance()
+	if err != nil || len(restored) != len(dict) || restored["key42"].Value != "changed" {
+		t.Errorf("---> TEST: Restored %v keys, expected %v. err:%v", len(restored), len(dict), err)
+	}
+}
+
+func TestBTreePersistanceFallbackOnCorruptedTree(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "BTREE", Backend: BACKEND_BTREE}
+	p, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Persist(&map[string]Entry{"key1": {Value: "value1"}})
+	p.Persist(&map[string]Entry{"key1": {Value: "value2"}})
+
+	// corrupt the root of the latest commit
+	f, _ := os.OpenFile(filepath.Join(config.Dir, "BTREE.db"), os.O_WRONLY, 0660)
+	f.WriteAt([]byte("broken"), int64(p.db.meta.root*BTREE_PAGE_SIZE)+10)
+	f.Close()
+
+	p2, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := p2.RestoreFromPersistance()
+	if err != nil || dict["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Got %v, expected previous commit. err:%v", dict, err)
+	}
+	if p2.Persist(&map[string]Entry{"key1": {Value: "value3"}}) == "" {
+		t.Error("---> TEST: Persist after fallback failed")
+	}
+}
+
+func TestBTreeCompaction(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "BTREE", Backend: BACKEND_BTREE}
+	p, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := map[string]Entry{"counter": {Value: "0"}}
+	for i := 1; i <= 2*BTREE_COMPACT_SLACK; i++ {
+		dict["counter"] = Entry{Value: strconv.Itoa(i), Version: uint64(i)}
+		p.Persist(&dict)
+	}
+	if p.db.meta.pages > BTREE_COMPACT_SLACK+4 {
+		t.Errorf("---> TEST: File is not compacted, pages:%v", p.db.meta.pages)
+	}
+	restored, err := p.RestoreFromPersistance()
+	if err != nil || restored["counter"].Value != strconv.Itoa(2*BTREE_COMPACT_SLACK) {
+		t.Errorf("---> TEST: Got %v after compaction. err:%v", restored, err)
+	}
+}
+
+func TestBTreeCompactionFails(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "BTREE", Backend: BACKEND_BTREE}
+	p, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the compacted file fails every compaction, commits go on into the current file
+	os.MkdirAll(filepath.Join(p.db.path+".compact", "busy"), 0770)
+	dict := map[string]Entry{"counter": {Value: "0"}}
+	for i := 1; i <= 2*BTREE_COMPACT_SLACK; i++ {
+		dict["counter"] = Entry{Value: strconv.Itoa(i), Version: uint64(i)}
+		if p.Persist(&dict) == "" {
+			t.Fatalf("---> TEST: Persist %v failed", i)
+		}
+	}
+	if p.db.meta.pages <= BTREE_COMPACT_SLACK+4 {
+		t.Errorf("---> TEST: File is compacted, pages:%v", p.db.meta.pages)
+	}
+	p2, err := NewBTreePersistance(300, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := p2.RestoreFromPersistance()
+	if err != nil || restored["counter"].Value != strconv.Itoa(2*BTREE_COMPACT_SLACK) {
+		t.Errorf("---> TEST: Got %v after failed compactions. err:%v", restored, err)
+	}
+}
+
+func TestStoreWithBTreeBackend(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "BTREE", Backend: BACKEND_BTREE}
+	s := openStore(t, Options{Interval: 300, Fsync: FSYNC_ALWAYS, Persistance: config})
+	s.Create(context.Background(), map[string]string{"key1": "value1"}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("---> TEST: Shutdown failed. err:%v", err)
+	}
+	s2 := openStore(t, Options{Interval: 300, Persistance: config})
+	if e, err := s2.Get(context.Background(), "key1"); err != nil || e.Value != "value1" {
+		t.Errorf("---> TEST: Got %v after restart, err:%v", e, err)
+	}
+}
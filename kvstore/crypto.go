@@ -0,0 +1,183 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const ENCRYPTION_MAGIC = "GOKVENC1" // first bytes of an encrypted snapshot or write ahead log record
+
+// ErrWrongKey is returned when data is encrypted with a key which is not in the keyring
+// Restore does not fall back to older snapshots on this error, the store must not start with an empty dict
+var ErrWrongKey = errors.New("wrong encryption key")
+
+// Keyring holds AES-GCM keys by key id, data is encrypted with the current key and decrypted with the key of its header
+// Keys are rotated by adding a new current key, older keys are kept to read data encrypted before the rotation
+//
+// Encrypted data is: magic, key id length (1 byte), key id, key fingerprint (8 bytes), nonce (12 bytes), sealed data
+// Fingerprint tells a wrong key with the same id from corrupted data
+type Keyring struct {
+	current string
+	keys    map[string]keyringKey
+}
+
+type keyringKey struct {
+	aead        cipher.AEAD
+	fingerprint []byte
+}
+
+// NewKeyring creates an empty keyring
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]keyringKey)}
+}
+
+// Add adds a 16, 24 or 32 bytes AES key as the current key, empty id is derived from the key
+func (k *Keyring) Add(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("goapp key fingerprint"))
+	fingerprint := mac.Sum(nil)[:8]
+	if id == "" {
+		id = hex.EncodeToString(fingerprint[:4])
+	}
+	if len(id) > 255 {
+		return errors.New("key id is longer than 255 bytes")
+	}
+	k.keys[id] = keyringKey{aead: aead, fingerprint: fingerprint}
+	k.current = id
+	return nil
+}
+
+// KeyId gives the id of the current key
+func (k *Keyring) KeyId() string {
+	return k.current
+}
+
+// ParseKey decodes a key given in hex or base64
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("key must be hex or base64 encoded")
+}
+
+// LoadKeyringFile reads a key file, each line is a key optionally preceded by its id and a space
+// The last key is the current key; empty lines and lines starting with # are ignored
+func LoadKeyringFile(filename string) (*Keyring, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keyring := NewKeyring()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id := ""
+		if fields := strings.Fields(line); len(fields) == 2 {
+			id, line = fields[0], fields[1]
+		}
+		key, err := ParseKey(line)
+		if err == nil {
+			err = keyring.Add(id, key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", filename, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keyring.current == "" {
+		return nil, fmt.Errorf("%v has no key", filename)
+	}
+	return keyring, nil
+}
+
+// IsEncrypted checks the magic bytes
+func IsEncrypted(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(ENCRYPTION_MAGIC))
+}
+
+// Seal encrypts data with the current key
+func (k *Keyring) Seal(plain []byte) []byte {
+	key := k.keys[k.current]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err) // the system random source never fails
+	}
+	buf := make([]byte, 0, len(ENCRYPTION_MAGIC)+1+len(k.current)+len(key.fingerprint)+len(nonce)+len(plain)+key.aead.Overhead())
+	buf = append(buf, ENCRYPTION_MAGIC...)
+	buf = append(buf, byte(len(k.current)))
+	buf = append(buf, k.current...)
+	buf = append(buf, key.fingerprint...)
+	buf = append(buf, nonce...)
+	return key.aead.Seal(buf, nonce, plain, buf[:len(buf)-len(nonce)])
+}
+
+// Open decrypts data encrypted by Seal, nil keyring has no keys
+// Returns ErrWrongKey if the key is not in the keyring, other errors mean the data is corrupted
+func (k *Keyring) Open(buf []byte) ([]byte, error) {
+	id, err := EncryptionKeyId(buf)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, fmt.Errorf("%w: data is encrypted with key %v but no key is given", ErrWrongKey, id)
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: data is encrypted with key %v which is not in the keyring", ErrWrongKey, id)
+	}
+	header := len(ENCRYPTION_MAGIC) + 1 + len(id)
+	if len(buf) < header+len(key.fingerprint)+key.aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	if !hmac.Equal(buf[header:header+len(key.fingerprint)], key.fingerprint) {
+		return nil, fmt.Errorf("%w: key %v does not match the key data is encrypted with", ErrWrongKey, id)
+	}
+	nonce := buf[header+len(key.fingerprint) : header+len(key.fingerprint)+key.aead.NonceSize()]
+	plain, err := key.aead.Open(nil, nonce, buf[header+len(key.fingerprint)+key.aead.NonceSize():], buf[:header+len(key.fingerprint)])
+	if err != nil {
+		return nil, errors.New("encrypted data is corrupted")
+	}
+	return plain, nil
+}
+
+// EncryptionKeyId reads the key id from the header of encrypted data
+func EncryptionKeyId(buf []byte) (string, error) {
+	if !IsEncrypted(buf) || len(buf) < len(ENCRYPTION_MAGIC)+1 {
+		return "", errors.New("data is not encrypted")
+	}
+	n := int(buf[len(ENCRYPTION_MAGIC)])
+	if len(buf) < len(ENCRYPTION_MAGIC)+1+n {
+		return "", errors.New("encrypted data is truncated")
+	}
+	return string(buf[len(ENCRYPTION_MAGIC)+1 : len(ENCRYPTION_MAGIC)+1+n]), nil
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, id string, key string) *Keyring {
+	keyring := NewKeyring()
+	if err := keyring.Add(id, []byte(key)); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "ENC", KeepLast: 3, Compression: COMPRESSION_GZIP}
+	config.Keyring = testKeyring(t, "k1", "0123456789abcdef0123456789abcdef")
+	p := NewPersistance(300, config)
+	filename := p.Persist(&map[string]Entry{"token": {Value: "secret-token"}})
+
+	buf, _ := ioutil.ReadFile(filename)
+	if !IsEncrypted(buf) || bytes.Contains(buf, []byte("secret-token")) {
+		t.Errorf("---> TEST: Snapshot is not encrypted")
+	}
+	dict, err := p.RestoreFromPersistance()
+	if err != nil || dict["token"].Value != "secret-token" {
+		t.Errorf("---> TEST: Got %v, err:%v", dict, err)
+	}
+	infos, _ := p.ListSnapshots()
+	if len(infos) != 1 || infos[0].KeyId != "k1" {
+		t.Errorf("---> TEST: Got %v, expected key id k1", infos)
+	}
+
+	// after rotation files of the previous key are still read
+	config.Keyring.Add("k2", []byte("fedcba9876543210fedcba9876543210"))
+	p = NewPersistance(300, config)
+	if dict, err := p.RestoreFromPersistance(); err != nil || dict["token"].Value != "secret-token" {
+		t.Errorf("---> TEST: Got %v after rotation, err:%v", dict, err)
+	}
+}
+
+func TestEncryptedSnapshotWrongKey(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "ENC", KeepLast: 3}
+	NewPersistance(300, config).Persist(&map[string]Entry{"key1": {Value: "plain"}})
+	config.Keyring = testKeyring(t, "k1", "0123456789abcdef0123456789abcdef")
+	NewPersistance(300, config).Persist(&map[string]Entry{"key1": {Value: "encrypted"}})
+
+	// same key id with another key, restore must not fall back to the older plain file
+	config.Keyring = testKeyring(t, "k1", "fedcba9876543210fedcba9876543210")
+	if _, err := NewPersistance(300, config).RestoreFromPersistance(); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("---> TEST: Got %v, expected %v", err, ErrWrongKey)
+	}
+	config.Keyring = nil
+	if _, err := NewPersistance(300, config).RestoreFromPersistance(); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("---> TEST: Got %v without key, expected %v", err, ErrWrongKey)
+	}
+
+	if _, err := Open(Options{Interval: 300, Persistance: config}); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("---> TEST: Store must not open with a wrong key, got %v", err)
+	}
+}
+
+func TestEncryptedWal(t *testing.T) {
+	dir := t.TempDir()
+	keyring := testKeyring(t, "", "0123456789abcdef0123456789abcdef")
+	wal, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_ALWAYS, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"token": {Value: "secret-token", Version: 1}}})
+	wal.Close()
+	buf, _ := ioutil.ReadFile(wal.filename(wal.seq))
+	if bytes.Contains(buf, []byte("secret-token")) {
+		t.Errorf("---> TEST: Wal is not encrypted")
+	}
+
+	wal2, _ := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, keyring)
+	dict := make(map[string]Entry)
+	if n, _, err := wal2.Replay(dict); n != 1 || err != nil || dict["token"].Value != "secret-token" {
+		t.Errorf("---> TEST: Replayed %v records, got %v, err:%v", n, dict, err)
+	}
+	wal2.Close()
+
+	wal3, _ := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, testKeyring(t, "", "fedcba9876543210fedcba9876543210"))
+	defer wal3.Close()
+	if _, _, err := wal3.Replay(make(map[string]Entry)); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("---> TEST: Got %v, expected %v", err, ErrWrongKey)
+	}
+}
+
+func TestLoadKeyringFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys")
+	content := "# rotated keys, the last one is current\nold 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n\nnew " + strings.Repeat("QUFB", 8) + "\n"
+	os.WriteFile(filename, []byte(content), 0600)
+	keyring, err := LoadKeyringFile(filename)
+	if err != nil || keyring.KeyId() != "new" || len(keyring.keys) != 2 {
+		t.Errorf("---> TEST: Got %v, err:%v", keyring, err)
+	}
+
+	os.WriteFile(filename, []byte("short 0001\n"), 0600)
+	if _, err := LoadKeyringFile(filename); err == nil {
+		t.Error("---> TEST: Invalid key size must fail")
+	}
+}
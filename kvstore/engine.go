@@ -0,0 +1,305 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store engines
+const (
+	ENGINE_CHANNEL = "channel" // all operations are serialized through one listener routine
+	ENGINE_SHARDED = "sharded" // operations run concurrently on lock striped shards
+)
+
+const DEFAULT_ENGINE = ENGINE_SHARDED
+const DEFAULT_SHARDS = 64        // number of shards of sharded engine
+const OPERATION_QUEUE_SIZE = 100 // buffer of operationChan of channel engine, max operations in flight of sharded engine
+
+// ErrQueueFull is returned when engine cannot take an operation, the client should retry later
+var ErrQueueFull = errors.New("operation queue is full")
+
+// StoreConfig selects the engine executing operations, Shards is used by sharded engine only
+type StoreConfig struct {
+	Engine string
+	Shards int
+}
+
+// DefaultStoreConfig gives sharded engine with DEFAULT_SHARDS shards
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{Engine: DEFAULT_ENGINE, Shards: DEFAULT_SHARDS}
+}
+
+// ParseStoreConfig validates engine name and number of shards, empty name gives DEFAULT_ENGINE and zero shards DEFAULT_SHARDS
+func ParseStoreConfig(engine string, shards int) (StoreConfig, error) {
+	config := DefaultStoreConfig()
+	switch engine {
+	case "":
+	case ENGINE_CHANNEL, ENGINE_SHARDED:
+		config.Engine = engine
+	default:
+		return config, fmt.Errorf("unknown store engine %v, expected channel or sharded", engine)
+	}
+	if shards < 0 {
+		return config, fmt.Errorf("number of shards must be positive, got %v", shards)
+	} else if shards > 0 {
+		config.Shards = shards
+	}
+	return config, nil
+}
+
+// engine executes operations on the shards of Store, responses are given via respData and ack of the operation
+// An engine also handles persistance and sweeper ticks, it stops after opShutdown is executed
+// Execute returns an error if the operation is not taken, then nothing is sent to respData and ack
+type engine interface {
+	Execute(op operation) error
+}
+
+// newEngine creates the engine selected by config for the store and starts it
+func newEngine(s *Store, config StoreConfig) engine {
+	if config.Engine == ENGINE_CHANNEL {
+		return newChannelEngine(s)
+	}
+	return newShardedEngine(s)
+}
+
+// channelEngine is the single writer design, one listener routine executes operations one by one in arrival order
+// Operations are queued in operationChan, ticks are handled between operations
+type channelEngine struct {
+	s             *Store
+	operationChan chan operation
+}
+
+// newChannelEngine creates a channelEngine and starts its listener
+func newChannelEngine(s *Store) *channelEngine {
+	c := &channelEngine{s: s, operationChan: make(chan operation, OPERATION_QUEUE_SIZE)}
+	go c.listen()
+	return c
+}
+
+// Execute queues the operation, returns ErrQueueFull if the queue is full and ErrClosed after the store is stopped
+// opShutdown is never rejected, it waits for a free slot
+func (c *channelEngine) Execute(op operation) error {
+	if op.oper == opShutdown {
+		c.operationChan <- op
+		return nil
+	}
+	select {
+	case <-c.s.done:
+		return ErrClosed
+	default:
+	}
+	select {
+	case c.operationChan <- op:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// listen waits for operations, persistance timer and sweeper in a go routine
+func (c *channelEngine) listen() {
+	for {
+		select {
+		case t := <-c.s.persistance.Ticker():
+			c.s.persistTick(t)
+		case t := <-c.s.sweeper.C:
+			c.s.sweep(t)
+		case op := <-c.operationChan:
+			c.s.execute(op)
+			if op.oper == opShutdown {
+				return
+			}
+		}
+	}
+}
+
+// shardedEngine executes each operation in a routine of its own, shard locks serialize operations on the same shard
+// so operations on different keys run in parallel; a routine handles ticks
+// slots bounds the operations in flight, an operation takes a slot until it is executed
+type shardedEngine struct {
+	s     *Store
+	done  chan bool
+	slots chan struct{}
+}
+
+// newShardedEngine creates a shardedEngine and starts its ticker routine
+func newShardedEngine(s *Store) *shardedEngine {
+	st := &shardedEngine{s: s, done: make(chan bool), slots: make(chan struct{}, OPERATION_QUEUE_SIZE)}
+	go st.tick()
+	return st
+}
+
+// Execute starts the operation, it waits for the locks of the shards it works on while the caller waits its ack
+// or its context. Returns ErrQueueFull if OPERATION_QUEUE_SIZE operations are in flight
+// opShutdown is never rejected, it runs in the routine of the caller
+func (st *shardedEngine) Execute(op operation) error {
+	if op.oper == opShutdown {
+		st.s.execute(op)
+		close(st.done)
+		return nil
+	}
+	select {
+	case st.slots <- struct{}{}:
+	default:
+		return ErrQueueFull
+	}
+	go func() {
+		defer func() { <-st.slots }()
+		st.s.execute(op)
+	}()
+	return nil
+}
+
+// tick waits for persistance timer and sweeper until shutdown
+func (st *shardedEngine) tick() {
+	for {
+		select {
+		case t := <-st.s.persistance.Ticker():
+			st.s.persistTick(t)
+		case t := <-st.s.sweeper.C:
+			st.s.sweep(t)
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// shard is a part of the dict, keys are assigned to shards by hash
+// dirty keys are written or deleted since the shard is sent to persistance
+// shared is set when the dict of the shard is sent to persistance, persistance reads it while writes go on, so the dict
+// is copied on the next change (copy on write) and the sent dict is never changed
+// mu guards all fields, a routine holding the locks of several shards takes them in shard order
+type shard struct {
+	mu     sync.RWMutex
+	dict   map[string]Entry
+	dirty  map[string]bool
+	shared bool
+}
+
+func newShard() *shard {
+	return &shard{dict: make(map[string]Entry), dirty: make(map[string]bool)}
+}
+
+// get finds the entry of given key, an expired entry is not found. Read lock is enough
+func (sh *shard) get(key string, now time.Time) (Entry, bool) {
+	e, ok := sh.dict[key]
+	if ok && e.Expired(now) {
+		return Entry{}, false
+	}
+	return e, ok
+}
+
+// lookup finds the entry of given key same as get, an expired entry is deleted. Write lock is needed
+func (sh *shard) lookup(key string, now time.Time) (Entry, bool) {
+	e, ok := sh.dict[key]
+	if ok && e.Expired(now) {
+		sh.own()
+		delete(sh.dict, key)
+		return Entry{}, false
+	}
+	return e, ok
+}
+
+// put stores the entry and marks the key dirty
+func (sh *shard) put(key string, e Entry) {
+	sh.own()
+	sh.dict[key] = e
+	sh.dirty[key] = true
+}
+
+// remove deletes a key and marks it dirty
+func (sh *shard) remove(key string) {
+	sh.own()
+	delete(sh.dict, key)
+	sh.dirty[key] = true
+}
+
+// reset replaces the dict, nothing is dirty since the whole dict will be persisted
+func (sh *shard) reset(dict map[string]Entry) {
+	sh.dict = dict
+	sh.dirty = make(map[string]bool)
+	sh.shared = false
+}
+
+// share gives the dict to send to persistance, the dict is not changed anymore once it is shared
+func (sh *shard) share() map[string]Entry {
+	sh.shared = true
+	return sh.dict
+}
+
+// own copies the dict if it is shared, it must be called before each change of the dict
+func (sh *shard) own() {
+	if !sh.shared {
+		return
+	}
+	dict := make(map[string]Entry, len(sh.dict))
+	for k, e := range sh.dict {
+		dict[k] = e
+	}
+	sh.dict = dict
+	sh.shared = false
+}
+
+// shardIndex gives the shard of a key by fnv hash
+func (s *Store) shardIndex(key string) int {
+	if len(s.shards) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// shardOf gives the shard of a key
+func (s *Store) shardOf(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// lockKeys write locks the shards of given keys in shard order, returns the function unlocking them
+func (s *Store) lockKeys(keys []string) func() {
+	seen := make(map[int]bool, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for _, k := range keys {
+		if i := s.shardIndex(k); !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			s.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// lockAll write locks all shards, returns the function unlocking them
+func (s *Store) lockAll() func() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	return func() {
+		for _, sh := range s.shards {
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// rlockAll read locks all shards, returns the function unlocking them
+func (s *Store) rlockAll() func() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	return func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}
+}
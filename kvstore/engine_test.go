@@ -0,0 +1,389 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var engines = []string{ENGINE_CHANNEL, ENGINE_SHARDED}
+
+// openStore opens a store with given options, the test fails if it cannot be opened
+func openStore(t testing.TB, opts Options) *Store {
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("---> TEST: Cannot open store. err:%v", err)
+	}
+	return s
+}
+
+// newEngineStore opens a store of given engine persisting into memory
+func newEngineStore(t testing.TB, engine string) *Store {
+	return openStore(t, Options{Interval: 300, Persistance: PersistanceConfig{Backend: BACKEND_MEMORY}, Store: StoreConfig{Engine: engine}})
+}
+
+func TestShardCopiesOnWrite(t *testing.T) {
+	sh := newShard()
+	sh.put("key1", Entry{Value: "value1"})
+	shared := sh.share()
+	sh.put("key1", Entry{Value: "changed"})
+	sh.put("key2", Entry{Value: "value2"})
+	if len(shared) != 1 || shared["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Shared dict is changed: %v", shared)
+	}
+	if len(sh.dict) != 2 || sh.dict["key1"].Value != "changed" {
+		t.Errorf("---> TEST: Got %v", sh.dict)
+	}
+}
+
+func TestParseStoreConfig(t *testing.T) {
+	if config, err := ParseStoreConfig("", 0); err != nil || config != DefaultStoreConfig() {
+		t.Errorf("---> TEST: Got %v, err:%v", config, err)
+	}
+	if config, err := ParseStoreConfig(ENGINE_CHANNEL, 8); err != nil || config.Engine != ENGINE_CHANNEL || config.Shards != 8 {
+		t.Errorf("---> TEST: Got %v, err:%v", config, err)
+	}
+	if _, err := ParseStoreConfig("actor", 0); err == nil {
+		t.Errorf("---> TEST: Unknown engine must fail")
+	}
+	if _, err := ParseStoreConfig(ENGINE_SHARDED, -1); err == nil {
+		t.Errorf("---> TEST: Negative shards must fail")
+	}
+}
+
+func TestOpenInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Interval: -1},
+		{Fsync: "sometimes"},
+		{Store: StoreConfig{Engine: "actor"}},
+		{Persistance: PersistanceConfig{Backend: "redis"}},
+	} {
+		if _, err := Open(opts); err == nil {
+			t.Errorf("---> TEST: Open with %+v must fail", opts)
+		}
+	}
+
+	// a directory in place of the first segment fails write ahead log
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "NOWAL-wal-1.log"), 0770)
+	if _, err := Open(Options{Persistance: PersistanceConfig{Dir: dir, Prefix: "NOWAL"}}); err == nil {
+		t.Error("---> TEST: Open without write ahead log must fail")
+	}
+}
+
+func TestConcurrentIncrement(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					s.Increment(context.Background(), "counter", json.Number("1"))
+				}
+			}()
+		}
+		wg.Wait()
+		if e, err := s.Get(context.Background(), "counter"); err != nil || e.Value != "1000" {
+			t.Errorf("---> TEST: %v engine got %v, err:%v, expected 1000", engine, e, err)
+		}
+	}
+}
+
+func TestIncrementInt(t *testing.T) {
+	s := newEngineStore(t, ENGINE_SHARDED)
+	ctx := context.Background()
+	if e, err := s.IncrementInt(ctx, "counter", 2); err != nil || e.Value != "2" {
+		t.Errorf("---> TEST: Got %v err:%v, expected 2", e, err)
+	}
+	s.Set(ctx, "ratio", "1.5", SetOptions{Upsert: true})
+	if _, err := s.IncrementInt(ctx, "ratio", 1); !errors.Is(err, ErrNotNumber) {
+		t.Errorf("---> TEST: Integer increment of a float got %v, expected %v", err, ErrNotNumber)
+	}
+	if e, _ := s.Get(ctx, "ratio"); e.Value != "1.5" {
+		t.Errorf("---> TEST: Float value is changed to %v", e.Value)
+	}
+}
+
+func TestScanWalk(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		ctx := context.Background()
+		pairs := make(map[string]string)
+		for i := 0; i < 200; i++ {
+			pairs[fmt.Sprintf("walk%03d", i)] = "value"
+		}
+		pairs["other"] = "value"
+		s.Create(ctx, pairs, 0)
+
+		// pages of 7 keys give all keys with the prefix once and in order
+		var keys []string
+		page := Page{More: true}
+		for after := ""; page.More; after = keys[len(keys)-1] {
+			var err error
+			if page, err = s.Scan(ctx, "walk", after, 7); err != nil || len(page.Keys) > 7 {
+				t.Fatalf("---> TEST: %v engine page after %v got %v err:%v", engine, after, page.Keys, err)
+			}
+			keys = append(keys, page.Keys...)
+		}
+		if len(keys) != 200 || !sort.StringsAreSorted(keys) || keys[0] != "walk000" {
+			t.Errorf("---> TEST: %v engine walked %v keys, expected 200 keys in order", engine, len(keys))
+		}
+	}
+}
+
+func TestImportSkipsExpired(t *testing.T) {
+	s := newEngineStore(t, ENGINE_SHARDED)
+	ctx := context.Background()
+	now := time.Now()
+	entries := map[string]Entry{
+		"live":    NewEntry("value", time.Minute, now),
+		"expired": {Value: "value", ExpiresAt: now.Add(-time.Millisecond).UnixMilli()},
+	}
+	written, err := s.Import(ctx, entries, true)
+	if err != nil || len(written) != 1 || written["live"].ExpiresAt == 0 {
+		t.Errorf("---> TEST: Import got %v err:%v, expected only the live entry", written, err)
+	}
+	if _, err := s.Get(ctx, "expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("---> TEST: Expired entry is imported, got %v", err)
+	}
+}
+
+func TestConcurrentCreateIsAtomic(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		// keys fall into different shards, only one of the racing creates may write them
+		pairs := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			pairs["key"+strconv.Itoa(i)] = "value"
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		created := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := s.Create(context.Background(), pairs, 0); err == nil {
+					mu.Lock()
+					created++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		page, _ := s.Scan(context.Background(), "", "", 100)
+		if created != 1 || len(page.Keys) != len(pairs) {
+			t.Errorf("---> TEST: %v engine created %v times, listed %v keys", engine, created, len(page.Keys))
+		}
+	}
+}
+
+// TestQueueFull applies to channel engine only, sharded engine has no queue
+func TestQueueFull(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		// channel engine listener waits the lock on the first operation and the rest fill the queue,
+		// sharded engine operations wait the lock in their routines
+		s.shards[0].mu.Lock()
+		n := OPERATION_QUEUE_SIZE
+		if engine == ENGINE_CHANNEL {
+			n++ // the listener takes one from the queue
+		}
+		for i := 0; i < n; i++ {
+			op := newOperation(opStats)
+			op.ctx = context.Background()
+			op.stats = make(chan Stats, 1)
+			for s.engine.Execute(*op) != nil {
+				time.Sleep(time.Millisecond) // the listener has not taken the first one yet
+			}
+		}
+		_, err := s.Get(context.Background(), "key1")
+		s.shards[0].mu.Unlock()
+		if !errors.Is(err, ErrQueueFull) {
+			t.Errorf("---> TEST: %v engine got %v, expected %v", engine, err, ErrQueueFull)
+		}
+		// slots are given back after the operations are executed
+		time.Sleep(10 * time.Millisecond)
+		if _, err = s.Get(context.Background(), "key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("---> TEST: %v engine got %v after the queue is drained, expected %v", engine, err, ErrNotFound)
+		}
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		// the shard of the key is locked, channel engine listener waits the lock on a blocking operation so the update
+		// stays in the queue, sharded engine update waits the lock
+		sh := s.shardOf("key1")
+		sh.mu.Lock()
+		blocking := newOperation(opGet)
+		blocking.ctx = context.Background()
+		blocking.key = "key1"
+		s.engine.Execute(*blocking)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err := s.Set(ctx, "key1", "value1", SetOptions{Upsert: true})
+		cancel()
+		sh.mu.Unlock()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("---> TEST: %v engine got %v, expected %v", engine, err, context.DeadlineExceeded)
+		}
+		// the waiting operation is abandoned, it is not executed after the timeout
+		time.Sleep(10 * time.Millisecond)
+		if _, err = s.Get(context.Background(), "key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("---> TEST: %v engine executed a timed out update, got %v", engine, err)
+		}
+	}
+}
+
+func TestCanceledOperation(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := s.Set(ctx, "key1", "value1", SetOptions{Upsert: true}); !errors.Is(err, context.Canceled) {
+			t.Errorf("---> TEST: %v engine got %v, expected %v", engine, err, context.Canceled)
+		}
+		if _, err := s.Get(context.Background(), "key1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("---> TEST: %v engine executed a canceled operation, got %v", engine, err)
+		}
+	}
+}
+
+func TestClosedStore(t *testing.T) {
+	for _, engine := range engines {
+		s := newEngineStore(t, engine)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.Close(ctx); err != nil {
+			t.Fatalf("---> TEST: %v engine cannot close. err:%v", engine, err)
+		}
+		// later operations and closing again fail instead of waiting forever
+		if _, _, err := s.Set(ctx, "key1", "value1", SetOptions{Upsert: true}); !errors.Is(err, ErrClosed) {
+			t.Errorf("---> TEST: %v engine Set got %v, expected %v", engine, err, ErrClosed)
+		}
+		if _, err := s.Get(ctx, "key1"); !errors.Is(err, ErrClosed) {
+			t.Errorf("---> TEST: %v engine Get got %v, expected %v", engine, err, ErrClosed)
+		}
+		if err := s.Close(ctx); !errors.Is(err, ErrClosed) {
+			t.Errorf("---> TEST: %v engine second Close got %v, expected %v", engine, err, ErrClosed)
+		}
+	}
+}
+
+func TestStoreMethods(t *testing.T) {
+	s := newEngineStore(t, ENGINE_SHARDED)
+	ctx := context.Background()
+	if _, _, err := s.Set(ctx, "key1", "value1", SetOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("---> TEST: Set of a missing key got %v, expected %v", err, ErrNotFound)
+	}
+	if _, existed, err := s.Set(ctx, "key1", "value1", SetOptions{Upsert: true}); err != nil || existed {
+		t.Errorf("---> TEST: Upsert got existed:%v err:%v", existed, err)
+	}
+	e, _ := s.Get(ctx, "key1")
+	if prev, existed, err := s.Set(ctx, "key1", "value2", SetOptions{IfMatch: e.ETag()}); err != nil || !existed || prev != e {
+		t.Errorf("---> TEST: Set with matching tag got %v %v err:%v", prev, existed, err)
+	}
+	if _, _, err := s.Set(ctx, "key1", "value3", SetOptions{IfMatch: e.ETag()}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("---> TEST: Set with stale tag got %v, expected %v", err, ErrPreconditionFailed)
+	}
+	if current, err := s.Create(ctx, map[string]string{"key1": "x", "key2": "y"}, 0); !errors.Is(err, ErrConflict) || current["key1"].Value != "value2" {
+		t.Errorf("---> TEST: Create of an existing key got %v err:%v", current, err)
+	}
+	expected := "value1"
+	if current, exists, err := s.CompareAndSwap(ctx, "key1", &expected, "value3", 0); !errors.Is(err, ErrConflict) || !exists || current.Value != "value2" {
+		t.Errorf("---> TEST: CompareAndSwap mismatch got %v %v err:%v", current, exists, err)
+	}
+	if _, err := s.CompareAndDelete(ctx, "key2", "y"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("---> TEST: CompareAndDelete of a missing key got %v, expected %v", err, ErrNotFound)
+	}
+	if _, err := s.Increment(ctx, "key1", json.Number("1")); !errors.Is(err, ErrNotNumber) {
+		t.Errorf("---> TEST: Increment of a string got %v, expected %v", err, ErrNotNumber)
+	}
+	for i := 0; i < 5; i++ {
+		s.Set(ctx, "page"+strconv.Itoa(i), "value", SetOptions{Upsert: true})
+	}
+	page, err := s.Scan(ctx, "page", "", 3)
+	if err != nil || len(page.Keys) != 3 || !page.More || page.Keys[0] != "page0" {
+		t.Errorf("---> TEST: First page got %v err:%v", page, err)
+	}
+	page, err = s.Scan(ctx, "page", page.Keys[2], 3)
+	if err != nil || len(page.Keys) != 2 || page.More || len(page.Entries) != 2 {
+		t.Errorf("---> TEST: Last page got %v err:%v", page, err)
+	}
+	for _, limit := range []int{0, -3} {
+		if _, err = s.Scan(ctx, "page", "", limit); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("---> TEST: Scan with limit %v got %v, expected %v", limit, err, ErrInvalidLimit)
+		}
+	}
+	if err = s.Delete(ctx, "key1"); err != nil {
+		t.Errorf("---> TEST: Delete got %v", err)
+	}
+	if err = s.Delete(ctx, "key1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("---> TEST: Delete of a missing key got %v, expected %v", err, ErrNotFound)
+	}
+	if e, err := s.Expire(ctx, "page0", time.Minute); err != nil || e.Value != "value" || e.ExpiresAt == 0 {
+		t.Errorf("---> TEST: Expire got %v err:%v", e, err)
+	}
+	if _, err := s.Expire(ctx, "key1", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("---> TEST: Expire of a missing key got %v, expected %v", err, ErrNotFound)
+	}
+	s.Set(ctx, "page0", "value", SetOptions{Upsert: true, TTL: time.Minute})
+	if stats, err := s.Stats(ctx); err != nil || stats.Keys != 5 || stats.Expiring != 1 || stats.Bytes != 50 || stats.Version == 0 {
+		t.Errorf("---> TEST: Stats got %+v err:%v", stats, err)
+	}
+}
+
+// benchmarkStore runs op in parallel on each engine, op works on key i%1000 of 1000 keys
+func benchmarkStore(b *testing.B, op func(s *Store, i int)) {
+	for _, engine := range engines {
+		b.Run(engine, func(b *testing.B) {
+			s := newEngineStore(b, engine)
+			for i := 0; i < 1000; i++ {
+				s.Set(context.Background(), "key"+strconv.Itoa(i), "value", SetOptions{Upsert: true})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(time.Now().UnixNano())
+				for pb.Next() {
+					i++
+					op(s, i)
+				}
+			})
+		})
+	}
+}
+
+// go test -run NONE -bench Store -cpu 1,4,8 ./kvstore
+func BenchmarkStoreGet(b *testing.B) {
+	benchmarkStore(b, func(s *Store, i int) {
+		s.Get(context.Background(), "key"+strconv.Itoa(i%1000))
+	})
+}
+
+func BenchmarkStoreSet(b *testing.B) {
+	benchmarkStore(b, func(s *Store, i int) {
+		s.Set(context.Background(), "key"+strconv.Itoa(i%1000), "value", SetOptions{Upsert: true})
+	})
+}
+
+func BenchmarkStoreMixed(b *testing.B) {
+	// 90% reads
+	benchmarkStore(b, func(s *Store, i int) {
+		if i%10 == 0 {
+			s.Set(context.Background(), "key"+strconv.Itoa(i%1000), "value", SetOptions{Upsert: true})
+		} else {
+			s.Get(context.Background(), "key"+strconv.Itoa(i%1000))
+		}
+	})
+}
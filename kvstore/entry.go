@@ -0,0 +1,79 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a value in the dictionary with its expiration time and version
+// ExpiresAt is in unix milliseconds, zero means the key never expires
+// Version is unique among all writes of the store, it changes whenever the entry is written
+type Entry struct {
+	Value     string `json:"value"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Version   uint64 `json:"version,omitempty"`
+}
+
+// NewEntry creates an entry expiring after ttl, zero ttl means the entry never expires
+func NewEntry(value string, ttl time.Duration, now time.Time) Entry {
+	e := Entry{Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = now.Add(ttl).UnixMilli()
+	}
+	return e
+}
+
+// Expired checks if the entry is expired at given time
+func (e Entry) Expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && e.ExpiresAt <= now.UnixMilli()
+}
+
+// TTL gives the remaining time to live, zero means the entry never expires
+func (e Entry) TTL(now time.Time) time.Duration {
+	if e.ExpiresAt == 0 {
+		return 0
+	}
+	return time.UnixMilli(e.ExpiresAt).Sub(now)
+}
+
+// ETag gives the strong entity tag of the entry
+func (e Entry) ETag() string {
+	return `"` + strconv.FormatUint(e.Version, 10) + `"`
+}
+
+// MatchETags checks if any of comma separated entity tags matches the entry, * matches any entry
+// weak comparison matches weak tags by their opaque value, it is used for If-None-Match. If-Match uses strong comparison
+// where a weak tag never matches (RFC 9110)
+func (e Entry) MatchETags(header string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == e.ETag() {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON writes entries without expiration and version as plain string values, same as older versions
+func (e Entry) MarshalJSON() ([]byte, error) {
+	if e.ExpiresAt == 0 && e.Version == 0 {
+		return json.Marshal(e.Value)
+	}
+	type entry Entry
+	return json.Marshal(entry(e))
+}
+
+// UnmarshalJSON accepts both a plain string value and an entry object
+func (e *Entry) UnmarshalJSON(buf []byte) error {
+	if len(buf) > 0 && buf[0] == '"' {
+		*e = Entry{}
+		return json.Unmarshal(buf, &e.Value)
+	}
+	type entry Entry
+	return json.Unmarshal(buf, (*entry)(e))
+}
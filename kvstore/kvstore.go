@@ -0,0 +1,485 @@
+// Package kvstore is the in memory key-value store of GOAPP, it can be embedded in process or served over HTTP by goapp
+// The dict is persisted by a backend selected by PersistanceConfig and each write is journaled into a write ahead log
+// before it is acknowledged, so a Store opened on the same data directory finds the data written before
+// Operations are executed by an engine selected by StoreConfig, all methods are safe for concurrent use
+//
+//	st, err := kvstore.Open(kvstore.Options{Persistance: kvstore.PersistanceConfig{Dir: "data", Prefix: "APP", Backend: kvstore.BACKEND_JSON}})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer st.Close(context.Background())
+//	st.Set(ctx, "key1", "value1", kvstore.SetOptions{Upsert: true})
+//	e, err := st.Get(ctx, "key1")
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_PERSISTANCE_INTERVAL = 300 // in seconds
+
+const DEFAULT_SWEEP_INTERVAL = 10 // in seconds, expired keys are deleted by the sweeper at each interval
+
+// Errors of Store methods, besides ErrQueueFull and the error of the context
+var (
+	ErrNotFound           = errors.New("key not found")
+	ErrConflict           = errors.New("current value does not match")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrNotNumber          = errors.New("value is not a number or result overflows")
+	ErrSnapshotFailed     = errors.New("snapshot failed")
+	ErrJournalFailed      = errors.New("write ahead log failed") // the write is not applied
+	ErrClosed             = errors.New("store is closed")
+	ErrInvalidLimit       = errors.New("limit must be positive")
+)
+
+// Store holds the shared dictionary
+// Keys may have an expiration time, expired keys are deleted lazily on access and by the sweeper ticker
+// Each write gives the entry a new version from version counter, versions are used as ETag for conditional requests
+// The dictionary is split into shards, operations are executed on the shards by engine
+// engine is selected by StoreConfig.Engine, it runs operations on the shards one by one or concurrently
+// persistance object is the backend selected by PersistanceConfig.Backend, it persists the dict and restores it on open
+// wal is the write ahead log, each write is appended to wal before it is acknowledged
+// cleared is set when the whole dict is replaced, it is guarded by the locks of all shards
+// gate is held shared by each operation and exclusively by opShutdown, so closed is set when no operation is running
+// closed is set by opShutdown while the locks of all shards are held too, operations after it fail with ErrClosed
+// done is closed when the store is stopped, closing is set by the first Close
+type Store struct {
+	shards      []*shard
+	engine      engine
+	persistance Persistance
+	sweeper     *time.Ticker
+	version     uint64 // accessed atomically
+	wal         *WriteAheadLog
+	cleared     bool
+	gate        sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	closing     int32 // accessed atomically
+}
+
+// SetOptions are the options of Set
+// TTL is the time to live of the value, zero never expires. Upsert creates a missing key instead of failing with ErrNotFound
+// IfMatch writes only if the entity tag of the current entry matches, IfNoneMatch: * writes only if the key does not exist
+type SetOptions struct {
+	TTL         time.Duration
+	Upsert      bool
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// Page is a page of Scan, keys are in order and More is set if there are keys after the last one
+type Page struct {
+	Keys    []string
+	Entries map[string]Entry
+	More    bool
+}
+
+// Stats are the counters of the dict at a moment, Bytes is the total length of live keys and values
+// Expiring is the number of keys with a time to live, Version is the latest version given to a write
+type Stats struct {
+	Keys     int    `json:"keys"`
+	Expiring int    `json:"expiring"`
+	Bytes    int64  `json:"bytes"`
+	Version  uint64 `json:"version"`
+	Shards   int    `json:"shards"`
+}
+
+// Options are the options of Open, zero values are the defaults
+// Interval is the persistance interval in seconds, zero is DEFAULT_PERSISTANCE_INTERVAL
+// Fsync is the FsyncPolicy of write ahead log, empty is DEFAULT_FSYNC_POLICY
+// Persistance is the data directory, file prefix, snapshot retention and backend, zero config is DefaultPersistanceConfig
+// Store selects the engine, empty engine is DEFAULT_ENGINE and zero shards DEFAULT_SHARDS
+type Options struct {
+	Interval    int
+	Fsync       FsyncPolicy
+	Persistance PersistanceConfig
+	Store       StoreConfig
+}
+
+// Open creates a store with given options, see Options for the defaults
+// Initializes shards, persistance and engine
+// peristance checks the file system for a previosly persisted dict, then write ahead log is replayed over it
+// Version counter continues from the counter persisted with them, so versions of deleted keys are not given again
+// Returns an error if an option is invalid
+// Returns ErrWrongKey if the data is encrypted with a key not given, starting with an empty dict would overwrite it
+// Returns an error if write ahead log cannot be opened, writes which are not journaled would be lost on a crash
+func Open(opts Options) (*Store, error) {
+	interval := opts.Interval
+	if interval < 0 {
+		return nil, fmt.Errorf("persistance interval must be positive, got %v", interval)
+	} else if interval == 0 {
+		interval = DEFAULT_PERSISTANCE_INTERVAL
+	}
+	policy, err := ParseFsyncPolicy(string(opts.Fsync))
+	if err != nil {
+		return nil, err
+	}
+	config := opts.Persistance
+	if config == (PersistanceConfig{}) {
+		config = DefaultPersistanceConfig()
+	}
+	storeConfig, err := ParseStoreConfig(opts.Store.Engine, opts.Store.Shards)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Store
+	s.cleared = true // the first persist is full
+	s.done = make(chan struct{})
+	persistance, err := NewBackend(interval, config)
+	if err != nil {
+		return nil, err
+	}
+	// read backup if exists
+	dict, err := persistance.RestoreFromPersistance()
+	if errors.Is(err, ErrWrongKey) {
+		persistance.Stop()
+		return nil, err
+	} else if err == nil {
+		s.version = persistance.Version()
+		log.Printf("INFO Data recovered from data directory. dict.len:%v version:%v \r\n", len(dict), s.version)
+	} else {
+		dict = make(map[string]Entry)
+	}
+	// replay writes after the snapshot, memory backend does not write anything to disk
+	// a store which cannot journal its writes would lose acknowledged writes on a crash, so it is not opened
+	if config.Backend != BACKEND_MEMORY {
+		s.wal, err = NewWriteAheadLog(config.Dir, config.Prefix, policy, config.Keyring)
+		if err != nil {
+			persistance.Stop()
+			return nil, fmt.Errorf("cannot open write ahead log: %w", err)
+		}
+		n, version, err := s.wal.Replay(dict)
+		if errors.Is(err, ErrWrongKey) {
+			persistance.Stop()
+			s.wal.Close()
+			return nil, err
+		}
+		if version > s.version {
+			s.version = version
+		}
+		log.Printf("INFO Write ahead log replayed. records:%v dict.len:%v version:%v \r\n", n, len(dict), s.version)
+	}
+	s.persistance = persistance
+	s.sweeper = time.NewTicker(DEFAULT_SWEEP_INTERVAL * time.Second)
+	// channel engine works on one shard, its operations are serialized anyway
+	n := 1
+	if storeConfig.Engine == ENGINE_SHARDED {
+		n = storeConfig.Shards
+	}
+	s.shards = make([]*shard, n)
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	s.load(dict)
+	s.engine = newEngine(&s, storeConfig)
+	return &s, nil
+}
+
+// do gives the operation to engine with a context and waits its ack
+// Returns ErrQueueFull if engine cannot take the operation, ctx error if ctx is done before the operation is executed
+// and the error of the operation if it fails, e.g. ErrJournalFailed. Returns ErrClosed once the store is stopped
+// An operation whose ctx is done is abandoned by engine if it is not started yet
+func (s *Store) do(ctx context.Context, op *operation) (bool, error) {
+	op.ctx = ctx
+	if err := s.engine.Execute(*op); err != nil {
+		return false, err
+	}
+	select {
+	case ack := <-op.ack:
+		return op.result(ack)
+	case <-ctx.Done():
+		// the operation may be executed meanwhile, its result is not lost then
+		select {
+		case ack := <-op.ack:
+			return op.result(ack)
+		default:
+			return false, ctx.Err()
+		}
+	case <-s.done:
+		// operations queued after opShutdown are never executed
+		select {
+		case ack := <-op.ack:
+			return op.result(ack)
+		default:
+			return false, ErrClosed
+		}
+	}
+}
+
+// Get gives the entry of a key, ErrNotFound if the key does not exist or is expired
+func (s *Store) Get(ctx context.Context, key string) (Entry, error) {
+	op := newOperation(opGet)
+	op.key = key
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, err
+	} else if !ack {
+		return Entry{}, ErrNotFound
+	}
+	return (<-op.respData)[key], nil
+}
+
+// Set writes the value of a key, gives the previous entry and true if the key existed
+// Fails with ErrNotFound if the key does not exist unless Upsert or IfNoneMatch: * is given, see SetOptions
+// Fails with ErrPreconditionFailed if a precondition of IfMatch or IfNoneMatch is not met
+func (s *Store) Set(ctx context.Context, key string, value string, opts SetOptions) (Entry, bool, error) {
+	op := newOperation(opUpdate)
+	op.key = key
+	op.value = value
+	op.ttl = opts.TTL
+	op.upsert = opts.Upsert
+	op.ifMatch = opts.IfMatch
+	op.ifNoneMatch = opts.IfNoneMatch
+	if _, err := s.do(ctx, op); err != nil {
+		return Entry{}, false, err
+	}
+	prev, ok := (<-op.respData)[key]
+	return prev, ok, nil
+}
+
+// Create writes all given pairs as a single operation and gives the written entries
+// Nothing is written if any of the keys exists, then the existing entries are given with ErrConflict
+func (s *Store) Create(ctx context.Context, pairs map[string]string, ttl time.Duration) (map[string]Entry, error) {
+	op := newOperation(opCreate)
+	op.pairs = pairs
+	op.ttl = ttl
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return nil, err
+	} else if !ack {
+		return <-op.respData, ErrConflict
+	}
+	return <-op.respData, nil
+}
+
+// Delete removes a key, ErrNotFound if the key does not exist
+func (s *Store) Delete(ctx context.Context, key string) error {
+	op := newOperation(opDelete)
+	op.key = key
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return err
+	} else if !ack {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteAll removes all keys
+func (s *Store) DeleteAll(ctx context.Context) error {
+	_, err := s.do(ctx, newOperation(opDeleteAll))
+	return err
+}
+
+// Scan gives at most limit keys with given prefix after the start key in order, empty after starts from the first key
+// A page is a consistent view of the dict, give the last key of a page as after to get the next page
+// Fails with ErrInvalidLimit if limit is less than 1
+func (s *Store) Scan(ctx context.Context, prefix string, after string, limit int) (Page, error) {
+	if limit < 1 {
+		return Page{}, ErrInvalidLimit
+	}
+	op := newOperation(opList)
+	op.key = prefix
+	op.after = after
+	op.limit = limit
+	if _, err := s.do(ctx, op); err != nil {
+		return Page{}, err
+	}
+	page := Page{Entries: <-op.respData}
+	page.Keys = make([]string, 0, len(page.Entries))
+	for k := range page.Entries {
+		page.Keys = append(page.Keys, k)
+	}
+	sort.Strings(page.Keys)
+	if len(page.Keys) > limit {
+		delete(page.Entries, page.Keys[limit])
+		page.Keys = page.Keys[:limit]
+		page.More = true
+	}
+	return page, nil
+}
+
+// CompareAndSwap writes the value only if the current value is the expected one, nil expects the key does not exist
+// Gives the written entry, or the current entry and whether the key exists with ErrConflict
+func (s *Store) CompareAndSwap(ctx context.Context, key string, expected *string, value string, ttl time.Duration) (Entry, bool, error) {
+	op := newOperation(opCAS)
+	op.key = key
+	op.value = value
+	op.expected = expected
+	op.ttl = ttl
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, ok := (<-op.respData)[key]
+	if !ack {
+		return e, ok, ErrConflict
+	}
+	return e, true, nil
+}
+
+// CompareAndDelete removes the key only if the current value is the expected one
+// Fails with ErrNotFound if the key does not exist, or gives the current entry with ErrConflict
+func (s *Store) CompareAndDelete(ctx context.Context, key string, expected string) (Entry, error) {
+	op := newOperation(opCAD)
+	op.key = key
+	op.expected = &expected
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, err
+	} else if ack {
+		return Entry{}, nil
+	}
+	if e, ok := (<-op.respData)[key]; ok {
+		return e, ErrConflict
+	}
+	return Entry{}, ErrNotFound
+}
+
+// Increment adds delta to the numeric value of a key and gives the new entry, a missing key counts as zero
+// Values are integers (int64) unless the value or delta is a fraction, then they are floats
+// Fails with ErrNotNumber if the current value is not a number or the result overflows
+func (s *Store) Increment(ctx context.Context, key string, delta json.Number) (Entry, error) {
+	op := newOperation(opIncr)
+	op.key = key
+	op.delta = delta
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, err
+	} else if !ack {
+		return Entry{}, ErrNotNumber
+	}
+	return (<-op.respData)[key], nil
+}
+
+// IncrementInt adds delta to the integer value of a key as a single operation and gives the new entry, a missing key counts as zero
+// Fails with ErrNotNumber if the current value is not an integer (int64) or the result overflows
+func (s *Store) IncrementInt(ctx context.Context, key string, delta int64) (Entry, error) {
+	op := newOperation(opIncr)
+	op.key = key
+	op.delta = json.Number(strconv.FormatInt(delta, 10))
+	op.integer = true
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, err
+	} else if !ack {
+		return Entry{}, ErrNotNumber
+	}
+	return (<-op.respData)[key], nil
+}
+
+// Expire sets the time to live of an existing key keeping its value and gives the written entry, zero ttl never expires
+// Fails with ErrNotFound if the key does not exist
+func (s *Store) Expire(ctx context.Context, key string, ttl time.Duration) (Entry, error) {
+	op := newOperation(opExpire)
+	op.key = key
+	op.ttl = ttl
+	ack, err := s.do(ctx, op)
+	if err != nil {
+		return Entry{}, err
+	} else if !ack {
+		return Entry{}, ErrNotFound
+	}
+	return (<-op.respData)[key], nil
+}
+
+// Snapshot persists the current dict now, regardless of changes since the latest snapshot, and gives the written file
+func (s *Store) Snapshot(ctx context.Context) (SnapshotInfo, error) {
+	op := newOperation(opSnapshot)
+	op.persisted = make(chan SnapshotInfo, 1)
+	if _, err := s.do(ctx, op); err != nil {
+		return SnapshotInfo{}, err
+	}
+	var info SnapshotInfo
+	select {
+	case info = <-op.persisted:
+	case <-ctx.Done():
+		return SnapshotInfo{}, ctx.Err()
+	}
+	if info.Filename == "" {
+		return info, ErrSnapshotFailed
+	}
+	return info, nil
+}
+
+// Snapshots lists snapshot files in data directory with sizes and timestamps, the latest is the first
+func (s *Store) Snapshots() ([]SnapshotInfo, error) {
+	return s.persistance.ListSnapshots()
+}
+
+// ReadSnapshot reads and verifies a snapshot file listed by Snapshots
+// Returns an error wrapping os.ErrNotExist if the file is not a snapshot of data directory
+func (s *Store) ReadSnapshot(name string) (map[string]Entry, error) {
+	return s.persistance.ReadSnapshot(name)
+}
+
+// Restore replaces all keys with the entries of dict, expired entries are dropped
+// The dict belongs to the store once it is given, the caller must not use it anymore
+func (s *Store) Restore(ctx context.Context, dict map[string]Entry) error {
+	op := newOperation(opRestore)
+	op.entries = dict
+	_, err := s.do(ctx, op)
+	return err
+}
+
+// Import writes given entries, existing keys are skipped unless overwrite is set. Gives the written entries
+// Expiration of the entries is kept, versions are given by the store. Expired entries are skipped
+func (s *Store) Import(ctx context.Context, entries map[string]Entry, overwrite bool) (map[string]Entry, error) {
+	op := newOperation(opImport)
+	op.entries = entries
+	op.upsert = overwrite
+	if _, err := s.do(ctx, op); err != nil {
+		return nil, err
+	}
+	return <-op.respData, nil
+}
+
+// Retain deletes all keys except the kept ones and gives the deleted entries
+func (s *Store) Retain(ctx context.Context, keep map[string]bool) (map[string]Entry, error) {
+	op := newOperation(opRetain)
+	op.keep = keep
+	if _, err := s.do(ctx, op); err != nil {
+		return nil, err
+	}
+	return <-op.respData, nil
+}
+
+// Stats counts the live keys of the dict, all shards are read locked while they are counted
+func (s *Store) Stats(ctx context.Context) (Stats, error) {
+	op := newOperation(opStats)
+	op.stats = make(chan Stats, 1)
+	if _, err := s.do(ctx, op); err != nil {
+		return Stats{}, err
+	}
+	return <-op.stats, nil
+}
+
+// Close persists the final dict regardless of changes and stops the store
+// Operations given before are executed and persisted, later ones fail with ErrClosed. Closing again gives ErrClosed
+// Returns ctx error if the final persist does not complete in time, the store is stopped anyway
+func (s *Store) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return ErrClosed
+	}
+	op := newOperation(opShutdown)
+	go s.engine.Execute(*op) // blocks while the queue is full
+	select {
+	case ack := <-op.ack:
+		if !ack {
+			return errors.New("final persist failed")
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,99 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const MEMORY_SNAPSHOT_NAME = "memory" // name of the only snapshot of MemoryPersistance
+
+// MemoryPersistance keeps a copy of the latest persisted dict in memory, nothing is written to disk
+// It is meant for tests and for instances which do not need durability; Store disables write ahead log with it
+type MemoryPersistance struct {
+	persistLoop
+	mu      sync.Mutex
+	dict    map[string]Entry
+	info    SnapshotInfo
+	version uint64
+}
+
+// NewMemoryPersistance creates a new MemoryPersistance and starts the timer
+func NewMemoryPersistance(interval int) *MemoryPersistance {
+	var p MemoryPersistance
+	p.StartTicker(interval)
+	return &p
+}
+
+// StartTicker starts the timer and listener
+func (p *MemoryPersistance) StartTicker(interval int) {
+	p.start(interval, p.persistRequest)
+}
+
+// persistRequest copies the dict of the request, deltas are not used
+func (p *MemoryPersistance) persistRequest(req PersistRequest) SnapshotInfo {
+	dict := req.Dict()
+	p.mu.Lock()
+	p.version = req.version
+	p.mu.Unlock()
+	return p.persist(&dict, req.force)
+}
+
+// Persist copies the dict
+func (p *MemoryPersistance) Persist(dict *map[string]Entry) string {
+	return p.persist(dict, false).Filename
+}
+
+// persist copies the dict, it is always persisted since copying costs as much as comparing
+func (p *MemoryPersistance) persist(dict *map[string]Entry, force bool) SnapshotInfo {
+	copied := make(map[string]Entry, len(*dict))
+	for k, e := range *dict {
+		copied[k] = e
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dict = copied
+	p.info = SnapshotInfo{Filename: MEMORY_SNAPSHOT_NAME, Size: int64(len(copied)), Time: time.Now()}
+	return p.info
+}
+
+// ListSnapshots gives the latest persisted dict if any, Size is the number of keys
+func (p *MemoryPersistance) ListSnapshots() ([]SnapshotInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dict == nil {
+		return []SnapshotInfo{}, nil
+	}
+	return []SnapshotInfo{p.info}, nil
+}
+
+// ReadSnapshot gives a copy of the latest persisted dict
+func (p *MemoryPersistance) ReadSnapshot(name string) (map[string]Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if name != MEMORY_SNAPSHOT_NAME || p.dict == nil {
+		return nil, os.ErrNotExist
+	}
+	dict := make(map[string]Entry, len(p.dict))
+	for k, e := range p.dict {
+		dict[k] = e
+	}
+	return dict, nil
+}
+
+// RestoreFromPersistance gives the latest persisted dict, a new instance has nothing to restore
+func (p *MemoryPersistance) RestoreFromPersistance() (map[string]Entry, error) {
+	dict, err := p.ReadSnapshot(MEMORY_SNAPSHOT_NAME)
+	if err != nil {
+		return nil, errors.New("nothing persisted in memory")
+	}
+	return dict, nil
+}
+
+// Version gives the version counter of the latest persisted dict
+func (p *MemoryPersistance) Version() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
@@ -0,0 +1,647 @@
+package kvstore
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type opType int // operation enum
+
+// Operation enum
+const (
+	opCreate    opType = 0
+	opGet              = 1
+	opDeleteAll        = 2
+	opDelete           = 3
+	opUpdate           = 4
+	opList             = 5
+	opCAS              = 6
+	opCAD              = 7
+	opIncr             = 8
+	opShutdown         = 9
+	opSnapshot         = 10
+	opRestore          = 11
+	opImport           = 12
+	opRetain           = 13
+	opStats            = 14
+	opExpire           = 15
+)
+
+// operation is data stucture for communication between the methods of Store and its engine
+// !!! Share Memory By Communicating !!!
+// oper is one of the operation enum, each method of Store sends one or more operations
+// key and value attributes are given by the caller, pairs is used by opCreate to write several pairs at once
+// upsert lets opUpdate create a missing key instead of failing and opImport overwrite existing keys, ttl is the time to live of written keys (zero never expires)
+// and the new time to live of opExpire
+// ifMatch and ifNoneMatch are conditional request headers, evaluated by opUpdate against the current entry
+// expected is the value opCAS and opCAD compare with the current value, nil expects the key does not exist
+// delta is the number opIncr adds to the current value, integer makes opIncr fail unless the current value is an integer
+// key is used as prefix and after as exclusive start key by opList, limit is the max number of pairs
+// ctx is the context of the caller, engine abandons the operation if ctx is done before the operation starts
+// entries is the dict loaded by opRestore or a chunk of opImport, persisted receives the file written by opSnapshot
+// keep is the set of keys opRetain does not delete, stats receives the counters of opStats
+// respData and ack is used to give response and ack to the caller, both are buffered so that the engine never waits the caller
+// failed receives the error of an operation which cannot be performed, it is sent before the false ack
+type operation struct {
+	ctx         context.Context
+	oper        opType
+	key         string
+	value       string
+	pairs       map[string]string
+	upsert      bool
+	ttl         time.Duration
+	ifMatch     string
+	ifNoneMatch string
+	expected    *string
+	delta       json.Number
+	integer     bool
+	entries     map[string]Entry
+	persisted   chan SnapshotInfo
+	keep        map[string]bool
+	stats       chan Stats
+	after       string
+	limit       int
+	respData    chan map[string]Entry
+	ack         chan bool
+	failed      chan error
+}
+
+// newOperation initializes an operation of given type, the caller gives it to engine and gets response via ack and respData
+func newOperation(oper opType) *operation {
+	var a operation
+	a.oper = oper
+	a.respData = make(chan map[string]Entry, 1)
+	a.ack = make(chan bool, 1)
+	a.failed = make(chan error, 1)
+	return &a
+}
+
+// fail responds an error instead of the result of the operation
+func (op operation) fail(err error) {
+	op.failed <- err
+	op.ack <- false
+}
+
+// result gives the ack of the operation with the error it failed with, if any. The ack must be received already
+func (op *operation) result(ack bool) (bool, error) {
+	if !ack {
+		select {
+		case err := <-op.failed:
+			return false, err
+		default:
+		}
+	}
+	return ack, nil
+}
+
+// execute performs an operation on the shards it works on and responds via respData and ack
+// The context is checked after the locks are taken, so an operation waiting for the locks longer than its caller is abandoned
+// Writes are journaled while the locks are held, so the log has the same order as the dict
+// A write is applied on the dict only after it is journaled, a write which cannot be journaled fails and changes nothing
+func (s *Store) execute(op operation) {
+	if op.oper == opShutdown {
+		s.gate.Lock()
+		defer s.gate.Unlock()
+	} else {
+		s.gate.RLock()
+		defer s.gate.RUnlock()
+	}
+	if s.closed {
+		op.fail(ErrClosed)
+		return
+	}
+	unlock := s.lock(op)
+	defer unlock()
+	if op.ctx != nil && op.ctx.Err() != nil {
+		// the caller does not wait the response anymore, the operation is not started and nothing is responded
+		log.Printf("WARN Operation %v abandoned. err:%v\r\n", op.oper, op.ctx.Err())
+		return
+	}
+	now := time.Now()
+	// Process the event by type
+	switch op.oper {
+	case opCreate:
+		// Add all given pairs to dictionary, then respond with written pairs
+		// Nothing is written if any of the keys exists, conflicting keys are responded instead
+		conflicts := make(map[string]Entry)
+		for k := range op.pairs {
+			if e, ok := s.shardOf(k).lookup(k, now); ok {
+				conflicts[k] = e
+			}
+		}
+		if len(conflicts) > 0 {
+			op.respData <- conflicts
+			op.ack <- false
+		} else {
+			written := make(map[string]Entry, len(op.pairs))
+			for k, v := range op.pairs {
+				written[k] = s.entry(v, op.ttl, now)
+			}
+			if err := s.commit(written); err != nil {
+				op.fail(err)
+				return
+			}
+			op.respData <- written
+			op.ack <- true
+		}
+	case opUpdate:
+		// Replace the value of an existing key, respond with the previous pair (empty when upserted)
+		// If-None-Match: * creates a missing key same as upsert
+		// Fails with ErrPreconditionFailed if a precondition is not met, then with ErrNotFound if the key does not exist
+		sh := s.shardOf(op.key)
+		old, ok := sh.lookup(op.key, now)
+		if !preconditions(op.ifMatch, op.ifNoneMatch, old, ok) {
+			op.fail(ErrPreconditionFailed)
+		} else if !ok && !op.upsert && op.ifNoneMatch != "*" {
+			op.fail(ErrNotFound)
+		} else if err := s.commit(map[string]Entry{op.key: s.entry(op.value, op.ttl, now)}); err != nil {
+			op.fail(err)
+		} else {
+			op.respData <- current(op.key, old, ok)
+			op.ack <- true
+		}
+	case opGet:
+		// Find the value by given key and respond, an expired key is left to the sweeper
+		sh := s.shardOf(op.key)
+		if e, ok := sh.get(op.key, now); ok {
+			op.respData <- map[string]Entry{op.key: e}
+			op.ack <- true
+		} else {
+			op.ack <- false
+		}
+	case opDeleteAll:
+		if err := s.journal(WalRecord{Op: WAL_CLEAR}); err != nil {
+			op.fail(err)
+			return
+		}
+		for _, sh := range s.shards {
+			sh.reset(make(map[string]Entry))
+		}
+		s.cleared = true
+		op.ack <- true
+	case opList:
+		// Collect the first keys with given prefix after the start key, respond one more pair than limit
+		// so that Scan can tell if there is a next page. Only a page of keys is kept, a page takes O(N log limit)
+		var h pageHeap
+		for _, sh := range s.shards {
+			for k, e := range sh.dict {
+				if e.Expired(now) || !strings.HasPrefix(k, op.key) || k <= op.after {
+					continue
+				}
+				if len(h) <= op.limit {
+					heap.Push(&h, pair{key: k, entry: e})
+				} else if k < h[0].key {
+					h[0] = pair{key: k, entry: e}
+					heap.Fix(&h, 0)
+				}
+			}
+		}
+		page := make(map[string]Entry, len(h))
+		for _, p := range h {
+			page[p.key] = p.entry
+		}
+		op.respData <- page
+		op.ack <- true
+	case opCAS:
+		// Write the new value only if the current value is the expected one, otherwise respond the current pair
+		sh := s.shardOf(op.key)
+		if old, ok := sh.lookup(op.key, now); compare(op.expected, old, ok) {
+			e := s.entry(op.value, op.ttl, now)
+			if err := s.commit(map[string]Entry{op.key: e}); err != nil {
+				op.fail(err)
+				return
+			}
+			op.respData <- map[string]Entry{op.key: e}
+			op.ack <- true
+		} else {
+			op.respData <- current(op.key, old, ok)
+			op.ack <- false
+		}
+	case opCAD:
+		// Delete the key only if the current value is the expected one, otherwise respond the current pair
+		sh := s.shardOf(op.key)
+		if old, ok := sh.lookup(op.key, now); ok && compare(op.expected, old, ok) {
+			if err := s.journal(WalRecord{Op: WAL_DEL, Keys: []string{op.key}}); err != nil {
+				op.fail(err)
+				return
+			}
+			sh.remove(op.key)
+			op.respData <- map[string]Entry{}
+			op.ack <- true
+		} else {
+			op.respData <- current(op.key, old, ok)
+			op.ack <- false
+		}
+	case opIncr:
+		// Add delta to the current numeric value, a missing key counts as zero. Time to live is kept
+		sh := s.shardOf(op.key)
+		old, ok := sh.lookup(op.key, now)
+		if !ok {
+			old.Value = "0"
+		}
+		if _, err := strconv.ParseInt(old.Value, 10, 64); err != nil && op.integer {
+			op.respData <- current(op.key, old, ok)
+			op.ack <- false
+		} else if value, err := increment(old.Value, op.delta); err == nil {
+			e := s.entry(value, 0, now)
+			e.ExpiresAt = old.ExpiresAt
+			if err := s.commit(map[string]Entry{op.key: e}); err != nil {
+				op.fail(err)
+				return
+			}
+			op.respData <- map[string]Entry{op.key: e}
+			op.ack <- true
+		} else {
+			op.respData <- current(op.key, old, ok)
+			op.ack <- false
+		}
+	case opExpire:
+		// Write the current value again with the new time to live, respond false if the key does not exist
+		sh := s.shardOf(op.key)
+		if old, ok := sh.lookup(op.key, now); ok {
+			e := s.entry(old.Value, op.ttl, now)
+			if err := s.commit(map[string]Entry{op.key: e}); err != nil {
+				op.fail(err)
+				return
+			}
+			op.respData <- map[string]Entry{op.key: e}
+			op.ack <- true
+		} else {
+			op.ack <- false
+		}
+	case opDelete:
+		// Remove the key from dictionary, respond false if it does not exist
+		sh := s.shardOf(op.key)
+		if _, ok := sh.lookup(op.key, now); !ok {
+			op.ack <- false
+		} else if err := s.journal(WalRecord{Op: WAL_DEL, Keys: []string{op.key}}); err != nil {
+			op.fail(err)
+		} else {
+			sh.remove(op.key)
+			op.ack <- true
+		}
+	case opShutdown:
+		// Persist the final dict, then stop. Operations executed before are persisted, operations arriving later
+		// fail with ErrClosed and the operations queued after opShutdown in channel engine are given up by do
+		s.persistance.Stop()
+		s.sweeper.Stop()
+		persisted := make(chan SnapshotInfo, 1)
+		s.takeDelta() // a forced persist is full
+		s.persistance.Send(PersistRequest{shards: s.share(), version: atomic.LoadUint64(&s.version), done: s.rotateJournal(), force: true, persisted: persisted})
+		info := <-persisted
+		if s.wal != nil {
+			s.wal.Close()
+		}
+		s.closed = true
+		close(s.done)
+		log.Printf("INFO Store stopped. Final dict persisted into %v", info.Filename)
+		op.ack <- info.Filename != ""
+	case opSnapshot:
+		// Send the dict to persistance now, Snapshot waits the persisted file
+		s.takeDelta() // a forced persist is full
+		s.persistance.Send(PersistRequest{shards: s.share(), version: atomic.LoadUint64(&s.version), done: s.rotateJournal(), force: true, persisted: op.persisted})
+		op.ack <- true
+	case opRestore:
+		// Replace the dict with the restored one, it is journaled as a whole so a crash does not undo it
+		for k, e := range op.entries {
+			if e.Expired(now) {
+				delete(op.entries, k)
+			}
+		}
+		if err := s.journal(WalRecord{Op: WAL_RESET, Entries: op.entries}); err != nil {
+			op.fail(err)
+			return
+		}
+		s.load(op.entries)
+		s.cleared = true
+		op.ack <- true
+	case opImport:
+		// Write a chunk of imported entries, existing keys are skipped unless upsert (replace mode) is given
+		// Entries expired since they are read are skipped, a zero time to live would never expire
+		// Respond written entries, the rest is skipped
+		written := make(map[string]Entry, len(op.entries))
+		for k, v := range op.entries {
+			if v.Expired(now) {
+				continue
+			}
+			sh := s.shardOf(k)
+			if _, ok := sh.lookup(k, now); ok && !op.upsert {
+				continue
+			}
+			var ttl time.Duration
+			if v.ExpiresAt > 0 {
+				ttl = time.UnixMilli(v.ExpiresAt).Sub(now)
+			}
+			written[k] = s.entry(v.Value, ttl, now)
+		}
+		if len(written) > 0 {
+			if err := s.commit(written); err != nil {
+				op.fail(err)
+				return
+			}
+		}
+		op.respData <- written
+		op.ack <- true
+	case opRetain:
+		// Delete all keys except the kept ones, respond deleted entries
+		deleted := make(map[string]Entry)
+		keys := make([]string, 0)
+		for _, sh := range s.shards {
+			for k, e := range sh.dict {
+				if !op.keep[k] {
+					deleted[k] = e
+					keys = append(keys, k)
+				}
+			}
+		}
+		if len(keys) > 0 {
+			if err := s.journal(WalRecord{Op: WAL_DEL, Keys: keys}); err != nil {
+				op.fail(err)
+				return
+			}
+		}
+		for _, k := range keys {
+			s.shardOf(k).remove(k)
+		}
+		op.respData <- deleted
+		op.ack <- true
+	case opStats:
+		// Count live keys and their size, expired keys are left to the sweeper
+		stats := Stats{Version: atomic.LoadUint64(&s.version), Shards: len(s.shards)}
+		for _, sh := range s.shards {
+			for k, e := range sh.dict {
+				if e.Expired(now) {
+					continue
+				}
+				stats.Keys++
+				stats.Bytes += int64(len(k) + len(e.Value))
+				if e.ExpiresAt != 0 {
+					stats.Expiring++
+				}
+			}
+		}
+		op.stats <- stats
+		op.ack <- true
+	default:
+		op.ack <- false
+	}
+}
+
+// lock takes the locks of the shards an operation works on, returns the function unlocking them
+// Operations on a key hold the lock of its shard, operations on the whole dict hold the locks of all shards
+// Reads hold read locks
+func (s *Store) lock(op operation) func() {
+	switch op.oper {
+	case opGet:
+		sh := s.shardOf(op.key)
+		sh.mu.RLock()
+		return sh.mu.RUnlock
+	case opUpdate, opCAS, opCAD, opIncr, opExpire, opDelete:
+		sh := s.shardOf(op.key)
+		sh.mu.Lock()
+		return sh.mu.Unlock
+	case opCreate:
+		keys := make([]string, 0, len(op.pairs))
+		for k := range op.pairs {
+			keys = append(keys, k)
+		}
+		return s.lockKeys(keys)
+	case opImport:
+		keys := make([]string, 0, len(op.entries))
+		for k := range op.entries {
+			keys = append(keys, k)
+		}
+		return s.lockKeys(keys)
+	case opList, opStats:
+		return s.rlockAll()
+	default:
+		return s.lockAll()
+	}
+}
+
+// persistTick sends the changes since the previous tick to persistance if there is any
+// All shards are locked only while they are marked shared, persistance reads them without blocking writes
+func (s *Store) persistTick(t time.Time) {
+	unlock := s.lockAll()
+	defer unlock()
+	if s.closed {
+		return
+	}
+	dirty := 0
+	for _, sh := range s.shards {
+		dirty += len(sh.dirty)
+	}
+	if dirty > 0 || s.cleared {
+		log.Printf("DEBUG Peristance timer tick at:%v. Send current dict to persistance. Dirty.len:%v", t, dirty)
+		s.persistance.Send(PersistRequest{shards: s.share(), version: atomic.LoadUint64(&s.version), delta: s.takeDelta(), done: s.rotateJournal()})
+	}
+}
+
+// load replaces the dicts of all shards with the entries of dict, the caller must hold the locks of all shards
+// version counter is raised to the highest version of the entries
+func (s *Store) load(dict map[string]Entry) {
+	dicts := make([]map[string]Entry, len(s.shards))
+	for i := range dicts {
+		dicts[i] = make(map[string]Entry)
+	}
+	for k, e := range dict {
+		dicts[s.shardIndex(k)][k] = e
+		for v := atomic.LoadUint64(&s.version); e.Version > v; v = atomic.LoadUint64(&s.version) {
+			if atomic.CompareAndSwapUint64(&s.version, v, e.Version) {
+				break
+			}
+		}
+	}
+	for i, sh := range s.shards {
+		sh.reset(dicts[i])
+	}
+}
+
+// entry creates a new entry with the next version, versions of entries which are not committed are skipped
+func (s *Store) entry(value string, ttl time.Duration, now time.Time) Entry {
+	e := NewEntry(value, ttl, now)
+	e.Version = atomic.AddUint64(&s.version, 1)
+	return e
+}
+
+// commit journals written entries, then stores them into the shards of their keys. The caller holds the locks of the shards
+// Nothing is stored if the entries cannot be journaled
+func (s *Store) commit(written map[string]Entry) error {
+	if err := s.journal(WalRecord{Op: WAL_SET, Entries: written}); err != nil {
+		return err
+	}
+	for k, e := range written {
+		s.shardOf(k).put(k, e)
+	}
+	return nil
+}
+
+// share gives the dicts of all shards to send to persistance, the caller must hold the locks of all shards
+func (s *Store) share() []map[string]Entry {
+	dicts := make([]map[string]Entry, len(s.shards))
+	for i, sh := range s.shards {
+		dicts[i] = sh.share()
+	}
+	return dicts
+}
+
+// takeDelta gives the changes since the previous call, the caller must hold the locks of all shards
+// Returns nil when the dict is cleared or replaced since then, a full snapshot is needed
+// Expired keys are not tracked, restore drops them anyway
+func (s *Store) takeDelta() *Delta {
+	var delta *Delta
+	if !s.cleared {
+		delta = &Delta{Entries: make(map[string]Entry)}
+	}
+	for _, sh := range s.shards {
+		if delta != nil {
+			for k := range sh.dirty {
+				if e, ok := sh.dict[k]; ok {
+					delta.Entries[k] = e
+				} else {
+					delta.Deleted = append(delta.Deleted, k)
+				}
+			}
+		}
+		sh.dirty = make(map[string]bool)
+	}
+	if delta != nil {
+		sort.Strings(delta.Deleted)
+	}
+	s.cleared = false
+	return delta
+}
+
+// journal appends a write to write ahead log, it must be called before the write is applied on the dict
+// Returns ErrJournalFailed if the record cannot be appended, then the write must fail
+// The record carries the version counter, the versions of its entries are already taken from it
+// Expirations are not journaled, replay drops expired entries
+func (s *Store) journal(record WalRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	record.Version = atomic.LoadUint64(&s.version)
+	if err := s.wal.Append(record); err != nil {
+		log.Printf("ERROR Cannot append to write ahead log. err:%v\r\n", err)
+		return fmt.Errorf("%w: %v", ErrJournalFailed, err)
+	}
+	return nil
+}
+
+// rotateJournal starts a new write ahead log segment when the dict is sent to persistance
+// returns the function truncating the log up to the rotation after the dict is persisted
+func (s *Store) rotateJournal() func() {
+	if s.wal == nil {
+		return nil
+	}
+	seq, err := s.wal.Rotate()
+	if err != nil {
+		log.Printf("ERROR Cannot rotate write ahead log. err:%v\r\n", err)
+		return nil
+	}
+	return func() { s.wal.Truncate(seq) }
+}
+
+// sweep deletes all expired entries shard by shard
+func (s *Store) sweep(now time.Time) {
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for k, e := range sh.dict {
+			if e.Expired(now) {
+				sh.own()
+				delete(sh.dict, k)
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	if n > 0 {
+		log.Printf("DEBUG Sweeper deleted %v expired keys.", n)
+	}
+}
+
+// preconditions evaluates If-Match and If-None-Match header values against the current entry of a key
+// If-Match fails if the key does not exist, If-None-Match fails if the key exists with a matching tag
+func preconditions(ifMatch string, ifNoneMatch string, e Entry, exists bool) bool {
+	if ifMatch != "" && (!exists || !e.MatchETags(ifMatch, false)) {
+		return false
+	}
+	if ifNoneMatch != "" && exists && e.MatchETags(ifNoneMatch, true) {
+		return false
+	}
+	return true
+}
+
+// compare checks the current entry of a key against the expected value, nil expected value matches a missing key
+func compare(expected *string, e Entry, exists bool) bool {
+	if expected == nil {
+		return !exists
+	}
+	return exists && e.Value == *expected
+}
+
+// current gives the pair of an existing key or an empty map for a missing key
+func current(key string, e Entry, exists bool) map[string]Entry {
+	if !exists {
+		return map[string]Entry{}
+	}
+	return map[string]Entry{key: e}
+}
+
+// pair is a key with its entry
+type pair struct {
+	key   string
+	entry Entry
+}
+
+// pageHeap is a max heap of pairs by key, opList keeps the first keys of a page in it and replaces the last one
+// with a smaller key
+type pageHeap []pair
+
+func (h pageHeap) Len() int            { return len(h) }
+func (h pageHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h pageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pageHeap) Push(x interface{}) { *h = append(*h, x.(pair)) }
+func (h *pageHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// increment adds delta to a numeric value, integers stay integers unless delta is a fraction
+// fails if the value is not a number or the result overflows
+func increment(value string, delta json.Number) (string, error) {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if d, err := delta.Int64(); err == nil {
+			if (d > 0 && i > math.MaxInt64-d) || (d < 0 && i < math.MinInt64-d) {
+				return "", errors.New("integer overflow")
+			}
+			return strconv.FormatInt(i+d, 10), nil
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", errors.New("value is not a number")
+	}
+	d, err := delta.Float64()
+	if err != nil {
+		return "", errors.New("delta is not a number")
+	}
+	result := f + d
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return "", errors.New("float overflow")
+	}
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
@@ -0,0 +1,17 @@
+package kvstore
+
+import (
+	"testing"
+)
+
+func TestIncrementOverflow(t *testing.T) {
+	if _, err := increment("9223372036854775807", "1"); err == nil {
+		t.Errorf("---> TEST: Expected integer overflow")
+	}
+	if _, err := increment("-9223372036854775808", "-1"); err == nil {
+		t.Errorf("---> TEST: Expected integer overflow")
+	}
+	if result, err := increment("10", "-3"); err != nil || result != "7" {
+		t.Errorf("---> TEST: Got %v %v, expected 7", result, err)
+	}
+}
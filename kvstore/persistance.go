@@ -0,0 +1,795 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TODO: Prevent working on huge files, consider seperating files when size gets huge
+// TODO: Monitor file handlers open/close actions, do not leave open file descriptors
+// TODO: when multiple instances run synch changes to other instances
+
+// Persistance interface starts a timer, timer tick is listen by parent (Store) object
+// Waits current dict from the parent (Store) object via Send then persist it in a go routine
+// On startup it check the backend storage for a previosly persisted dict
+// Expiration times of keys are persisted with values, the version counter of Store is persisted with the dict
+// so that the versions of deleted keys are not given again after restart
+// Store depends only on this interface, backends are FSPersistance (json snapshot files), BTreePersistance (b-tree file)
+// and MemoryPersistance (nothing is written to disk, for tests)
+type Persistance interface {
+	StartTicker(interval int)
+	Ticker() <-chan time.Time
+	Send(req PersistRequest)
+	Stop()
+	Persist(dict *map[string]Entry) string
+	RestoreFromPersistance() (map[string]Entry, error)
+	Version() uint64
+	ListSnapshots() ([]SnapshotInfo, error)
+	ReadSnapshot(name string) (map[string]Entry, error)
+}
+
+// Persistance backends
+const (
+	BACKEND_JSON   = "json"   // FSPersistance, a json snapshot file per persist
+	BACKEND_BTREE  = "btree"  // BTreePersistance, changed keys are written into a b-tree file
+	BACKEND_MEMORY = "memory" // MemoryPersistance, keeps the latest persisted dict in memory
+)
+
+const DEFAULT_BACKEND = BACKEND_JSON
+
+// Snapshot compressions of FSPersistance
+// TODO: zstd compresses faster, but it needs a dependency outside the standard library
+const (
+	COMPRESSION_NONE = "none" // <prefix>-<timestamp>.json
+	COMPRESSION_GZIP = "gzip" // <prefix>-<timestamp>.json.gz
+)
+
+const SNAPSHOT_EXT = ".json"
+const DELTA_EXT = ".delta.json" // <prefix>-<timestamp of base>-<seq>.delta.json
+const GZIP_EXT = ".gz"
+
+var gzipMagic = []byte{0x1f, 0x8b} // first bytes of a gzip stream
+
+// ParseCompression validates a compression name, empty name is COMPRESSION_NONE
+func ParseCompression(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", COMPRESSION_NONE:
+		return COMPRESSION_NONE, nil
+	case COMPRESSION_GZIP:
+		return COMPRESSION_GZIP, nil
+	case "zstd":
+		return "", errors.New("zstd compression is not supported, use gzip")
+	default:
+		return "", fmt.Errorf("unknown compression %v, expected none or gzip", name)
+	}
+}
+
+const DEFAULT_FILE_PREFIX = "GOAPP"  // prefix of snapshot and write ahead log files
+const DEFAULT_SNAPSHOT_KEEP_LAST = 2 // the latest snapshot and the previous one as fallback
+const DEFAULT_DELTA_LIMIT = 10       // delta snapshots written after a full snapshot before the next full one
+
+// PersistanceConfig defines where files are written and which snapshots are kept
+// Dir is the data directory, default is os.TempDir(). Prefix distinguishes files of instances sharing the directory
+// Snapshots are deleted when they are not one of KeepLast latest snapshots and older than KeepFor (zero KeepFor is ignored)
+// Backend is one of BACKEND_JSON, BACKEND_BTREE, BACKEND_MEMORY, empty is DEFAULT_BACKEND
+// Compression of json snapshots is COMPRESSION_NONE or COMPRESSION_GZIP, empty is none; files of both are restored
+// Snapshots and write ahead log are encrypted with the current key of Keyring if given, only json backend supports encryption
+// DeltaLimit is the number of delta snapshots json backend writes after a full snapshot, zero writes only full snapshots
+type PersistanceConfig struct {
+	Dir         string
+	Prefix      string
+	KeepLast    int
+	KeepFor     time.Duration
+	Backend     string
+	Compression string
+	Keyring     *Keyring
+	DeltaLimit  int
+}
+
+// DefaultPersistanceConfig gives the config used when no config is given
+func DefaultPersistanceConfig() PersistanceConfig {
+	return PersistanceConfig{Dir: os.TempDir(), Prefix: DEFAULT_FILE_PREFIX, KeepLast: DEFAULT_SNAPSHOT_KEEP_LAST, DeltaLimit: DEFAULT_DELTA_LIMIT}
+}
+
+// NewBackend creates the persistance backend selected by config
+func NewBackend(interval int, config PersistanceConfig) (Persistance, error) {
+	switch config.Backend {
+	case "", BACKEND_JSON:
+		return NewPersistance(interval, config), nil
+	case BACKEND_BTREE:
+		if config.Keyring != nil {
+			return nil, errors.New("btree backend does not support encryption, use json backend")
+		}
+		return NewBTreePersistance(interval, config)
+	case BACKEND_MEMORY:
+		return NewMemoryPersistance(interval), nil
+	default:
+		return nil, fmt.Errorf("unknown persistance backend %v, expected json, btree or memory", config.Backend)
+	}
+}
+
+// persistLoop holds ticker and persistanceChan to receive current dict from Store, it is shared by backends
+type persistLoop struct {
+	// ticker will be listened by Service object
+	// when timer ticks Service will send current dict to Persistance via persistanceChan
+	ticker          *time.Ticker
+	persistanceChan chan PersistRequest
+}
+
+// start starts the timer, and a go routine persists dicts received from Store with given persist function
+func (l *persistLoop) start(interval int, persist func(req PersistRequest) SnapshotInfo) {
+	l.persistanceChan = make(chan PersistRequest, 10) // it is not necessary to make it buffered.
+	// but when Persist takes longer than interval; making it buffered will prevent blocking main routine
+	l.ticker = time.NewTicker(time.Duration(interval) * 1000 * time.Millisecond)
+	// When Service routine sends data over channel; following routine will get dict and persist
+	go func() {
+		for {
+			req := <-l.persistanceChan
+			log.Printf("DEBUG Reecived dict at %v. shards:%v delta:%v", time.Now(), len(req.shards), req.delta != nil)
+			info := persist(req)
+			if info.Filename != "" && req.done != nil {
+				req.done()
+			}
+			if req.persisted != nil {
+				req.persisted <- info
+			}
+		}
+	}()
+}
+
+// Ticker gives the channel of timer ticks, Store sends the current dict at each tick
+func (l *persistLoop) Ticker() <-chan time.Time {
+	return l.ticker.C
+}
+
+// Send passes the dict to persist routine
+func (l *persistLoop) Send(req PersistRequest) {
+	l.persistanceChan <- req
+}
+
+// Stop stops the timer, dicts sent afterwards are still persisted
+func (l *persistLoop) Stop() {
+	l.ticker.Stop()
+}
+
+// FSPersistance writes json snapshot files, holds latest hash of persisted dict
+// After a succesful persist it deletes the old files by retention policy
+// Checks the hash of current and previosly persisted dictionary and decides to persist or not
+// Changes sent by Store are written as delta files chained onto the latest full snapshot (base), restore replays base and its deltas
+// base is the timestamp of the current base, deltas is the number of deltas written onto it
+// needFull is set when a persist fails, the changes of the failed request are only in the next full snapshot
+type FSPersistance struct {
+	persistLoop
+	latesHash uint32
+	config    PersistanceConfig
+	base      string
+	deltas    int
+	needFull  bool
+	version   uint64 // version counter written into headers, the highest one sent or restored
+}
+
+// PersistRequest carries the dicts of the shards of Store, they are not changed after they are sent
+// done is called after the dict is persisted into a new file, Store truncates write ahead log in done
+// force persists the dict even if it is not changed, the persisted file (empty on failure) is sent to persisted if given
+// delta is the change since the previous request, nil if the whole dict must be persisted
+// version is the version counter of Store when the dict is sent
+type PersistRequest struct {
+	shards    []map[string]Entry
+	version   uint64
+	delta     *Delta
+	done      func()
+	force     bool
+	persisted chan SnapshotInfo
+}
+
+// Dict gives the whole dict, the dicts of several shards are merged into a new one
+func (req PersistRequest) Dict() map[string]Entry {
+	if len(req.shards) == 1 {
+		return req.shards[0]
+	}
+	n := 0
+	for _, d := range req.shards {
+		n += len(d)
+	}
+	dict := make(map[string]Entry, n)
+	for _, d := range req.shards {
+		for k, e := range d {
+			dict[k] = e
+		}
+	}
+	return dict
+}
+
+// Delta is the change of the dict since the previous persist, Entries are written keys and Deleted are deleted keys
+type Delta struct {
+	Entries map[string]Entry `json:"entries,omitempty"`
+	Deleted []string         `json:"deleted,omitempty"`
+}
+
+// Apply performs the change on dict
+func (d *Delta) Apply(dict map[string]Entry) {
+	for k, e := range d.Entries {
+		dict[k] = e
+	}
+	for _, k := range d.Deleted {
+		delete(dict, k)
+	}
+}
+
+// SnapshotInfo describes a snapshot file, Hash is the checksum in the file header (empty for older files)
+// KeyId is the id of the key an encrypted file is encrypted with, its Hash is not given since the header is encrypted
+// Deltas is the number of delta files chained onto a full snapshot
+type SnapshotInfo struct {
+	Filename string    `json:"filename"`
+	Hash     string    `json:"hash,omitempty"`
+	KeyId    string    `json:"key_id,omitempty"`
+	Deltas   int       `json:"deltas,omitempty"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// NewPersistance creates a new FSPersistance with given config, initializes channel and starts the timer, and a go routine
+// listens dict from Store
+func NewPersistance(interval int, config PersistanceConfig) *FSPersistance {
+	var p FSPersistance
+	p.config = config
+	if err := os.MkdirAll(p.config.Dir, 0750); err != nil {
+		log.Printf("ERROR Cannot create data directory %v. err:%v\r\n", p.config.Dir, err)
+	}
+	p.StartTicker(interval)
+	return &p
+}
+
+// StartTicker starts the timer and listener
+func (p *FSPersistance) StartTicker(interval int) {
+	p.start(interval, p.persistRequest)
+}
+
+// persistRequest writes the delta of the request if it can be chained onto the current base, otherwise a full snapshot
+func (p *FSPersistance) persistRequest(req PersistRequest) SnapshotInfo {
+	if req.version > p.version {
+		p.version = req.version
+	}
+	if req.delta != nil && !req.force && !p.needFull && p.base != "" && p.deltas < p.config.DeltaLimit {
+		return p.persistDelta(req.delta)
+	}
+	dict := req.Dict()
+	return p.persist(&dict, req.force)
+}
+
+// SnapshotHeader is the first line of a snapshot file, the dict is written on the second line
+// Checksum is sha256 of the dict line in hex, it is verified before the dict is restored
+// Version is the version counter of Store when the file is written, zero in files of older versions
+// Files written by older versions have only the dict line without header
+type SnapshotHeader struct {
+	Checksum string `json:"checksum"`
+	Version  uint64 `json:"version,omitempty"`
+}
+
+// Persist writes current data to file system
+// It does not check the size of dict to able to write data after delete all operation
+// Compares hash values of current and previosly persisted dict and decides to persist or not
+// The file is written to a temp file, synced, then renamed, so a crash never leaves a partially written snapshot
+func (p *FSPersistance) Persist(dict *map[string]Entry) string {
+	return p.persist(dict, false).Filename
+}
+
+// ForcePersist writes current data to file system even if it is same as the previosly persisted dict
+func (p *FSPersistance) ForcePersist(dict *map[string]Entry) string {
+	return p.persist(dict, true).Filename
+}
+
+func (p *FSPersistance) persist(dict *map[string]Entry, force bool) SnapshotInfo {
+	/*if (len(*dict)) == 0 {
+		return SnapshotInfo{} // additional check
+	}*/
+
+	jsonStr, _err2 := json.Marshal(*dict)
+	if _err2 != nil {
+		log.Printf("ERROR json.Marshal failed. err:%v\r\n", _err2.Error())
+		return SnapshotInfo{}
+	}
+	same, hash := p.CheckIfHashIsSame(jsonStr)
+	if same && !force {
+		return SnapshotInfo{}
+	}
+
+	now := time.Now()
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	info, _err := p.write(filepath.Join(p.config.Dir, p.config.Prefix+"-"+ts+SNAPSHOT_EXT), jsonStr, now)
+	if _err != nil {
+		log.Printf("ERROR Write file failed. err:%v\r\n", _err.Error())
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+
+	p.latesHash = hash // update with new value
+	p.base = ts
+	p.deltas = 0
+	p.needFull = false
+	log.Printf("INFO dict (%v) persisted into %v", info.Size, info.Filename)
+	p.DeleteOldFiles(info.Filename)
+	return info
+}
+
+// persistDelta writes the delta as the next delta file of the current base
+func (p *FSPersistance) persistDelta(delta *Delta) SnapshotInfo {
+	jsonStr, _err := json.Marshal(delta)
+	if _err != nil {
+		log.Printf("ERROR json.Marshal failed. err:%v\r\n", _err.Error())
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	now := time.Now()
+	seq := p.deltas + 1
+	info, _err := p.write(filepath.Join(p.config.Dir, p.config.Prefix+"-"+p.base+"-"+strconv.Itoa(seq)+DELTA_EXT), jsonStr, now)
+	if _err != nil {
+		log.Printf("ERROR Write file failed. err:%v\r\n", _err.Error())
+		p.needFull = true
+		return SnapshotInfo{}
+	}
+	p.deltas = seq
+	p.latesHash = 0 // dict is not the same as the base anymore
+	log.Printf("INFO delta (%v keys written, %v deleted) persisted into %v", len(delta.Entries), len(delta.Deleted), info.Filename)
+	return info
+}
+
+// write writes the data line with its checksum header into filename, compressed and encrypted by config
+// The lines are streamed through the compressor into the file, an encrypted file is sealed at once so it is built in memory
+func (p *FSPersistance) write(filename string, jsonStr []byte, now time.Time) (SnapshotInfo, error) {
+	checksum := sha256.Sum256(jsonStr)
+	header, _ := json.Marshal(SnapshotHeader{Checksum: hex.EncodeToString(checksum[:]), Version: p.version})
+	content := func(w io.Writer) error {
+		for _, b := range [][]byte{header, {'\n'}, jsonStr, {'\n'}} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if p.config.Compression == COMPRESSION_GZIP {
+		lines := content
+		content = func(w io.Writer) error {
+			zw := gzip.NewWriter(w)
+			if err := lines(zw); err != nil {
+				return err
+			}
+			return zw.Close()
+		}
+		filename += GZIP_EXT
+	}
+	if p.config.Keyring != nil {
+		var buf bytes.Buffer
+		if err := content(&buf); err != nil {
+			return SnapshotInfo{}, err
+		}
+		sealed := p.config.Keyring.Seal(buf.Bytes())
+		content = func(w io.Writer) error {
+			_, err := w.Write(sealed)
+			return err
+		}
+	}
+	n, err := writeFileAtomic(filename, p.config.Prefix, content)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	return SnapshotInfo{Filename: filename, Hash: hex.EncodeToString(checksum[:]), Size: n, Time: time.UnixMilli(now.UnixMilli())}, nil
+}
+
+// writeFileAtomic writes the content given by write into a temp file with given prefix in the same directory, syncs and renames it
+// to filename then syncs the directory so that the rename survives a crash. Gives the size of the file
+// The temp file is removed and filename is left as it is if write fails
+func writeFileAtomic(filename string, prefix string, write func(w io.Writer) error) (int64, error) {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, prefix+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	var n int64
+	if err == nil {
+		n, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0660)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if d, err := os.Open(dir); err == nil {
+		if err := d.Sync(); err != nil {
+			log.Printf("WARNING Cannot sync directory %v. err:%v\r\n", dir, err)
+		}
+		d.Close()
+	}
+	return n, nil
+}
+
+// snapshotFiles lists <prefix>-<timestamp>.json and <prefix>-<timestamp>.json.gz files in data directory, the latest is the first
+func (p *FSPersistance) snapshotFiles() ([]string, error) {
+	files, _err := os.ReadDir(p.config.Dir)
+	if _err != nil {
+		log.Printf("WARNING Cannot read data directory %v. err:%v\r\n", p.config.Dir, _err)
+		return nil, _err
+	}
+	var names []string
+	timestamps := make(map[string]uint64)
+	for _, v := range files {
+		if strings.HasPrefix(v.Name(), p.config.Prefix+"-") && !v.IsDir() {
+			ts, err := strconv.ParseUint(p.snapshotTimestamp(v.Name()), 10, 64)
+			if err == nil && ts > 0 {
+				names = append(names, v.Name())
+				timestamps[v.Name()] = ts
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return timestamps[names[i]] > timestamps[names[j]] })
+	return names, nil
+}
+
+// snapshotTimestamp gives the timestamp part of a snapshot file name, empty if it is not a snapshot file name
+func (p *FSPersistance) snapshotTimestamp(name string) string {
+	name = strings.TrimSuffix(name, GZIP_EXT)
+	if !strings.HasPrefix(name, p.config.Prefix+"-") || !strings.HasSuffix(name, SNAPSHOT_EXT) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, p.config.Prefix+"-"), SNAPSHOT_EXT)
+}
+
+// snapshotTime gives the time a snapshot file is persisted, parsed from its name
+func (p *FSPersistance) snapshotTime(name string) time.Time {
+	ts, _ := strconv.ParseInt(p.snapshotTimestamp(name), 10, 64)
+	if ts < 1e11 {
+		return time.Unix(ts, 0) // older versions named files in seconds
+	}
+	return time.UnixMilli(ts)
+}
+
+// DeleteOldFiles deletes old files after a successful persist by the retention policy of config
+// Restore falls back to kept snapshots if the new file is corrupted
+func (p *FSPersistance) DeleteOldFiles(newFilename string) {
+	files, _err := p.snapshotFiles()
+	if _err != nil {
+		return
+	}
+
+	// Delete <prefix>-*.json files except the new file, KeepLast latest files and files younger than KeepFor
+	kept := 1
+	now := time.Now()
+	for _, v := range files {
+		filename := filepath.Join(p.config.Dir, v)
+		if filename == newFilename {
+			continue
+		}
+		if kept < p.config.KeepLast || (p.config.KeepFor > 0 && now.Sub(p.snapshotTime(v)) < p.config.KeepFor) {
+			kept++
+			continue
+		}
+		// deltas are deleted first, a base without its deltas would be restored as an older state
+		for _, d := range p.deltaFiles(v) {
+			p.removeFile(filepath.Join(p.config.Dir, d))
+		}
+		p.removeFile(filename)
+	}
+}
+
+func (p *FSPersistance) removeFile(filename string) {
+	_err := os.Remove(filename)
+	if _err != nil {
+		log.Printf("ERROR Cannot delete file %v. err:%v\r\n", filename, _err)
+	} else {
+		log.Printf("INFO Deleted file %v.\r\n", filename)
+	}
+}
+
+// deltaFiles lists delta files of a snapshot in data directory ordered by sequence number
+func (p *FSPersistance) deltaFiles(name string) []string {
+	files, err := os.ReadDir(p.config.Dir)
+	if err != nil {
+		return nil
+	}
+	prefix := p.config.Prefix + "-" + p.snapshotTimestamp(filepath.Base(name)) + "-"
+	seqs := make(map[string]int)
+	names := []string{}
+	for _, v := range files {
+		if seq := deltaSeq(v.Name(), prefix); seq > 0 {
+			seqs[v.Name()] = seq
+			names = append(names, v.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return seqs[names[i]] < seqs[names[j]] })
+	return names
+}
+
+// deltaSeq parses the sequence number of a delta file name with given prefix, 0 if it is not a delta file
+func deltaSeq(name string, prefix string) int {
+	name = strings.TrimSuffix(name, GZIP_EXT)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, DELTA_EXT) {
+		return 0
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), DELTA_EXT))
+	if err != nil || seq < 0 {
+		return 0
+	}
+	return seq
+}
+
+// readChain reads a snapshot file and applies its deltas in order
+// Replay stops at a missing or corrupted delta, the state up to the previous delta is returned
+func (p *FSPersistance) readChain(filename string) (map[string]Entry, uint64, int, error) {
+	dict, version, err := readSnapshot(filename, p.config.Keyring)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	prefix := p.config.Prefix + "-" + p.snapshotTimestamp(filepath.Base(filename)) + "-"
+	applied := 0
+	for _, v := range p.deltaFiles(filename) {
+		deltaname := filepath.Join(p.config.Dir, v)
+		if deltaSeq(v, prefix) != applied+1 {
+			log.Printf("WARNING Delta %v of %v is missing, later deltas are skipped.", applied+1, filename)
+			break
+		}
+		delta, deltaVersion, err := readDelta(deltaname, p.config.Keyring)
+		if errors.Is(err, ErrWrongKey) {
+			return nil, 0, 0, err
+		} else if err != nil {
+			log.Printf("WARNING Cannot read delta %v, later deltas are skipped. err:%v", deltaname, err)
+			break
+		}
+		delta.Apply(dict)
+		if deltaVersion > version {
+			version = deltaVersion
+		}
+		applied++
+	}
+	return dict, version, applied, nil
+}
+
+// ListSnapshots describes snapshot files in data directory, the latest is the first
+func (p *FSPersistance) ListSnapshots() ([]SnapshotInfo, error) {
+	files, err := p.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SnapshotInfo, 0, len(files))
+	for _, v := range files {
+		filename := filepath.Join(p.config.Dir, v)
+		stat, err := os.Stat(filename)
+		if err != nil {
+			continue // deleted meanwhile
+		}
+		info := SnapshotInfo{Filename: filename, Size: stat.Size(), Time: p.snapshotTime(v), Deltas: len(p.deltaFiles(v))}
+		if id, err := snapshotKeyId(filename); err == nil {
+			info.KeyId = id // header is encrypted too
+		} else if file, err := openSnapshot(filename, nil); err == nil {
+			line, _ := bufio.NewReader(file).ReadSlice('\n')
+			var header SnapshotHeader
+			if json.Unmarshal(line, &header) == nil {
+				info.Hash = header.Checksum
+			}
+			file.Close()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ReadSnapshot reads a snapshot file of data directory by its name with its deltas, checksums are verified
+// Only files listed by ListSnapshots can be read
+func (p *FSPersistance) ReadSnapshot(name string) (map[string]Entry, error) {
+	files, err := p.snapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range files {
+		if v == filepath.Base(name) {
+			dict, _, _, err := p.readChain(filepath.Join(p.config.Dir, v))
+			return dict, err
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// RestoreFromPersistance checks the file system for previosly persisted dict
+// The latest file with a valid checksum is restored with its deltas, corrupted files are skipped
+func (p *FSPersistance) RestoreFromPersistance() (map[string]Entry, error) {
+	files, _err := p.snapshotFiles()
+	if _err != nil {
+		return nil, _err
+	}
+
+	if len(files) == 0 {
+		log.Printf("INFO Cannot find any %v-*.json file in %v directory.", p.config.Prefix, p.config.Dir)
+		return nil, errors.New(fmt.Sprintf("INFO Cannot fing any %v-*.json file in %v directory.", p.config.Prefix, p.config.Dir))
+	}
+
+	for _, v := range files {
+		filename := filepath.Join(p.config.Dir, v)
+		dict, version, deltas, err := p.readChain(filename)
+		if errors.Is(err, ErrWrongKey) {
+			// older files are most likely encrypted with the same key, restoring one of them silently loses data
+			log.Printf("ERROR Cannot decrypt %v. err:%v", filename, err)
+			return nil, err
+		} else if err != nil {
+			log.Printf("ERROR Cannot restore %v, trying the previous file. err:%v", filename, err)
+			continue
+		}
+
+		// entries expired while the application was down are dropped
+		now := time.Now()
+		for k, e := range dict {
+			if e.Expired(now) {
+				delete(dict, k)
+			}
+		}
+		log.Printf("DEBUG restored %v with %v deltas dict.size: %v, version: %v, dict:%v", filename, deltas, len(dict), version, dict)
+		p.version = version
+		return dict, nil
+	}
+	log.Printf("ERROR All %v-*.json files in %v directory are corrupted.", p.config.Prefix, p.config.Dir)
+	return nil, errors.New(fmt.Sprintf("all %v-*.json files in %v directory are corrupted", p.config.Prefix, p.config.Dir))
+}
+
+// snapshotReader closes the decompressor and the file of a snapshot
+type snapshotReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *snapshotReader) Close() error {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// openSnapshot opens a snapshot file, gzip compression is detected by extension or magic bytes
+// An encrypted file is decrypted with the keyring at once, then it is decompressed
+func openSnapshot(filename string, keyring *Keyring) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(file)
+	closers := []io.Closer{file}
+	if magic, _ := br.Peek(len(ENCRYPTION_MAGIC)); IsEncrypted(magic) {
+		buf, err := ioutil.ReadAll(br)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		plain, err := keyring.Open(buf)
+		if err != nil {
+			return nil, err
+		}
+		closers = nil
+		br = bufio.NewReader(bytes.NewReader(plain))
+	}
+	magic, _ := br.Peek(len(gzipMagic))
+	if strings.HasSuffix(filename, GZIP_EXT) || bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			(&snapshotReader{closers: closers}).Close()
+			return nil, fmt.Errorf("cannot decompress: %v", err)
+		}
+		return &snapshotReader{Reader: zr, closers: append(closers, zr)}, nil
+	}
+	return &snapshotReader{Reader: br, closers: closers}, nil
+}
+
+// snapshotKeyId reads the key id of an encrypted snapshot without decrypting it
+func snapshotKeyId(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, len(ENCRYPTION_MAGIC)+1+255)
+	n, _ := io.ReadFull(file, buf)
+	return EncryptionKeyId(buf[:n])
+}
+
+// readSnapshot reads a snapshot file and verifies its checksum, files without header are read as plain dict
+// Compressed files are decompressed first, the checksum is of the uncompressed dict line
+// Gives the version counter in the header, zero for files without header
+func readSnapshot(filename string, keyring *Keyring) (map[string]Entry, uint64, error) {
+	data, version, err := readDataLine(filename, keyring)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dict map[string]Entry
+	if err := json.Unmarshal(data, &dict); err != nil {
+		return nil, 0, fmt.Errorf("cannot unmarshal dict: %v", err)
+	}
+	return dict, version, nil
+}
+
+// readDelta reads a delta file and verifies its checksum, gives the version counter in the header
+func readDelta(filename string, keyring *Keyring) (*Delta, uint64, error) {
+	data, version, err := readDataLine(filename, keyring)
+	if err != nil {
+		return nil, 0, err
+	}
+	var delta Delta
+	if err := json.Unmarshal(data, &delta); err != nil {
+		return nil, 0, fmt.Errorf("cannot unmarshal delta: %v", err)
+	}
+	return &delta, version, nil
+}
+
+// readDataLine reads the data line of a snapshot or delta file, checksum in the header line is verified
+// Gives the version counter in the header line
+func readDataLine(filename string, keyring *Keyring) ([]byte, uint64, error) {
+	file, err := openSnapshot(filename, keyring)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lines := bytes.SplitN(bytes.TrimRight(buf, "\n"), []byte("\n"), 2)
+	data := lines[0]
+	var header SnapshotHeader
+	if len(lines) == 2 {
+		if err := json.Unmarshal(lines[0], &header); err != nil {
+			return nil, 0, fmt.Errorf("cannot unmarshal header: %v", err)
+		}
+		data = lines[1]
+		checksum := sha256.Sum256(data)
+		if hex.EncodeToString(checksum[:]) != header.Checksum {
+			return nil, 0, errors.New("checksum mismatch")
+		}
+	}
+	return data, header.Version, nil
+}
+
+// Version gives the version counter of the latest restored or persisted file
+func (p *FSPersistance) Version() uint64 {
+	return p.version
+}
+
+// CheckIfHashIsSame compares hash values
+func (p *FSPersistance) CheckIfHashIsSame(buf []byte) (bool, uint32) {
+	h := fnv.New32a()
+	h.Write(buf)
+	hash := h.Sum32()
+	log.Printf("DEBUG Hash values: Current dict: %v. Previosly persisted dict: %v\r\n", hash, p.latesHash)
+	if p.latesHash == hash {
+		return true, hash
+	} else {
+		return false, hash
+	}
+}
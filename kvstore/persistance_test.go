@@ -0,0 +1,371 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersist(t *testing.T) {
+	pers := NewPersistance(30, DefaultPersistanceConfig())
+	dict := map[string]Entry{"A": {Value: "1"}, "B": {Value: "2"}, "C": {Value: "3"}, "D": {Value: "4"}}
+	filename := pers.Persist(&dict)
+	if filename == "" {
+		t.Errorf("---> TEST: Cannot create file")
+	}
+	err := os.Remove(filename)
+	if err != nil {
+		t.Errorf("---> TEST: Cannot delete created file (%v) in test case. err:%v", filename, err)
+	} else {
+		log.Printf("---> TEST: file '%v' deleted after test case", filename)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	pers := NewPersistance(30, DefaultPersistanceConfig())
+	dict := map[string]Entry{"A": {Value: "1"}, "B": {Value: "2"}, "C": {Value: "3"}, "D": {Value: "4"}}
+	filename := pers.Persist(&dict)
+	if filename == "" {
+		t.Errorf("---> TEST: Cannot create file")
+	}
+
+	dict, err := pers.RestoreFromPersistance()
+	if err != nil {
+		t.Errorf("---> TEST: Data recovered from tmp directory. dict.len:%v \r\n", len(dict))
+	}
+}
+
+func TestRestoreExpiration(t *testing.T) {
+	pers := NewPersistance(30, DefaultPersistanceConfig())
+	now := time.Now()
+	dict := map[string]Entry{"A": NewEntry("1", time.Hour, now), "B": {Value: "2", ExpiresAt: now.Add(-time.Second).UnixMilli()}}
+	filename := pers.Persist(&dict)
+	if filename == "" {
+		t.Fatalf("---> TEST: Cannot create file")
+	}
+	defer os.Remove(filename)
+
+	restored, err := pers.RestoreFromPersistance()
+	if err != nil {
+		t.Fatalf("---> TEST: Cannot restore. err:%v", err)
+	}
+	if restored["A"] != dict["A"] {
+		t.Errorf("---> TEST: Expiration is not restored. Got %v, expected %v", restored["A"], dict["A"])
+	}
+	if _, ok := restored["B"]; ok {
+		t.Errorf("---> TEST: Expired key is restored")
+	}
+}
+
+func TestEntryUnmarshalPlainValue(t *testing.T) {
+	var dict map[string]Entry
+	err := json.Unmarshal([]byte(`{"A": "1", "B": {"value": "2", "expiresAt": 42}}`), &dict)
+	if err != nil {
+		t.Fatalf("---> TEST: Cannot unmarshal. err:%v", err)
+	}
+	if dict["A"] != (Entry{Value: "1"}) || dict["B"] != (Entry{Value: "2", ExpiresAt: 42}) {
+		t.Errorf("---> TEST: Unmarshalled dict is wrong: %v", dict)
+	}
+}
+
+func TestRestoreFallbackOnCorruptedFile(t *testing.T) {
+	pers := NewPersistance(30, DefaultPersistanceConfig())
+	dict := map[string]Entry{"A": {Value: "good"}}
+	previous := pers.Persist(&dict)
+	time.Sleep(2 * time.Millisecond)
+	dict2 := map[string]Entry{"A": {Value: "corrupted"}}
+	latest := pers.Persist(&dict2)
+	if previous == "" || latest == "" {
+		t.Fatalf("---> TEST: Cannot create files")
+	}
+	defer os.Remove(previous)
+	defer os.Remove(latest)
+
+	// flip a byte of the dict line
+	buf, _ := os.ReadFile(latest)
+	buf[len(buf)-4] ^= 1
+	os.WriteFile(latest, buf, 0660)
+
+	restored, err := pers.RestoreFromPersistance()
+	if err != nil || restored["A"].Value != "good" {
+		t.Errorf("---> TEST: Previous file is not restored. Got %v, err:%v", restored, err)
+	}
+}
+
+func TestRestoreLegacyFile(t *testing.T) {
+	pers := NewPersistance(30, DefaultPersistanceConfig())
+	filename := filepath.Join(os.TempDir(), "GOAPP-"+strconv.FormatInt(time.Now().Add(time.Second).UnixMilli(), 10)+".json")
+	os.WriteFile(filename, []byte(`{"A":"1"}`+"\n"), 0660)
+	defer os.Remove(filename)
+
+	restored, err := pers.RestoreFromPersistance()
+	if err != nil || restored["A"].Value != "1" {
+		t.Errorf("---> TEST: Legacy file is not restored. Got %v, err:%v", restored, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "RETENTION", KeepLast: 2}
+	pers := NewPersistance(30, config)
+	for i := 0; i < 4; i++ {
+		dict := map[string]Entry{"A": {Value: strconv.Itoa(i)}}
+		if pers.Persist(&dict) == "" {
+			t.Fatalf("---> TEST: Cannot create file")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	files, _ := filepath.Glob(filepath.Join(config.Dir, "RETENTION-*.json"))
+	if len(files) != 2 {
+		t.Errorf("---> TEST: Got %v files, expected 2: %v", len(files), files)
+	}
+
+	// files younger than KeepFor are kept
+	config.KeepFor = time.Hour
+	pers = NewPersistance(30, config)
+	for i := 0; i < 2; i++ {
+		dict := map[string]Entry{"B": {Value: strconv.Itoa(i)}}
+		pers.Persist(&dict)
+		time.Sleep(2 * time.Millisecond)
+	}
+	files, _ = filepath.Glob(filepath.Join(config.Dir, "RETENTION-*.json"))
+	if len(files) != 4 {
+		t.Errorf("---> TEST: Got %v files, expected 4: %v", len(files), files)
+	}
+
+	// other prefixes are not touched
+	other := NewPersistance(30, PersistanceConfig{Dir: config.Dir, Prefix: "OTHER", KeepLast: 1})
+	if _, err := other.RestoreFromPersistance(); err == nil {
+		t.Errorf("---> TEST: Files of another prefix are restored")
+	}
+}
+
+func TestShutdownPersists(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "SHUTDOWN", KeepLast: 2}
+	s := openStore(t, Options{Interval: 300, Persistance: config})
+	if _, err := s.Create(context.Background(), map[string]string{"key1": "value1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("---> TEST: Shutdown failed. err:%v", err)
+	}
+
+	// final snapshot holds the dict, write ahead log is truncated
+	dict, err := NewPersistance(300, config).RestoreFromPersistance()
+	if err != nil || dict["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Final dict is not persisted. Got %v, err:%v", dict, err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(config.Dir, "SHUTDOWN-wal-*.log"))
+	if len(segments) != 1 {
+		t.Errorf("---> TEST: Got wal segments %v, expected only the last empty one", segments)
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, Options{Interval: 300, Persistance: PersistanceConfig{Dir: dir, Prefix: "MEMORY", Backend: BACKEND_MEMORY}})
+	s.Create(context.Background(), map[string]string{"key1": "value1"}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("---> TEST: Shutdown failed. err:%v", err)
+	}
+	dict, err := s.persistance.ReadSnapshot(MEMORY_SNAPSHOT_NAME)
+	if err != nil || dict["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Got %v, err:%v", dict, err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("---> TEST: Memory backend must not write files, got %v", files)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := NewBackend(300, PersistanceConfig{Backend: "redis"}); err == nil {
+		t.Error("---> TEST: Unknown backend must fail")
+	}
+}
+
+func TestCompressedSnapshot(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "GZIP", KeepLast: 3}
+	dict := map[string]Entry{"key1": {Value: strings.Repeat("value1", 1000)}}
+	p := NewPersistance(300, config)
+	plain := p.Persist(&dict)
+
+	time.Sleep(2 * time.Millisecond) // snapshots are named by milliseconds
+	config.Compression = COMPRESSION_GZIP
+	p = NewPersistance(300, config)
+	dict["key2"] = Entry{Value: "value2"}
+	compressed := p.Persist(&dict)
+	if !strings.HasSuffix(compressed, ".json.gz") {
+		t.Fatalf("---> TEST: Got %v, expected a .json.gz file", compressed)
+	}
+	plainStat, _ := os.Stat(plain)
+	compressedStat, _ := os.Stat(compressed)
+	if compressedStat.Size() >= plainStat.Size() {
+		t.Errorf("---> TEST: Compressed size %v is not less than %v", compressedStat.Size(), plainStat.Size())
+	}
+	restored, err := p.RestoreFromPersistance()
+	if err != nil || len(restored) != 2 {
+		t.Errorf("---> TEST: Got %v, err:%v", restored, err)
+	}
+	infos, _ := p.ListSnapshots()
+	if len(infos) != 2 || infos[0].Hash == "" || infos[1].Hash == "" {
+		t.Errorf("---> TEST: Compressed and plain snapshots must be listed with hashes, got %v", infos)
+	}
+
+	// a compressed file without extension is detected by magic bytes
+	os.Rename(compressed, strings.TrimSuffix(compressed, ".gz"))
+	restored, err = p.RestoreFromPersistance()
+	if err != nil || len(restored) != 2 {
+		t.Errorf("---> TEST: Got %v, err:%v", restored, err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ATOMIC-1.json")
+	n, err := writeFileAtomic(filename, "ATOMIC", func(w io.Writer) error {
+		_, err := w.Write([]byte("line1\n"))
+		return err
+	})
+	if stat, _ := os.Stat(filename); err != nil || stat == nil || stat.Size() != n || n != 6 {
+		t.Errorf("---> TEST: Got size %v, err:%v", n, err)
+	}
+
+	// a failing write, e.g. a compressor error, leaves neither the file nor the temp file
+	filename = filepath.Join(dir, "ATOMIC-2.json")
+	if _, err := writeFileAtomic(filename, "ATOMIC", func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("write failed")
+	}); err == nil {
+		t.Error("---> TEST: A failing write must fail")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("---> TEST: Got %v files, expected only the first file", len(files))
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	if c, err := ParseCompression(""); err != nil || c != COMPRESSION_NONE {
+		t.Errorf("---> TEST: Got %v, err:%v", c, err)
+	}
+	if _, err := ParseCompression("zstd"); err == nil {
+		t.Error("---> TEST: zstd must fail")
+	}
+}
+
+func TestDeltaSnapshots(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "DELTA", KeepLast: 1, DeltaLimit: 2}
+	p := NewPersistance(300, config)
+	dict := map[string]Entry{"key1": {Value: "value1"}, "key2": {Value: "value2"}}
+	base := p.persistRequest(PersistRequest{shards: []map[string]Entry{dict}})
+
+	dict["key3"] = Entry{Value: "value3"}
+	delete(dict, "key1")
+	first := p.persistRequest(PersistRequest{shards: []map[string]Entry{dict}, delta: &Delta{Entries: map[string]Entry{"key3": dict["key3"]}, Deleted: []string{"key1"}}})
+	if !strings.HasSuffix(first.Filename, "-1.delta.json") {
+		t.Fatalf("---> TEST: Got %v, expected the first delta of %v", first.Filename, base.Filename)
+	}
+	dict["key2"] = Entry{Value: "changed"}
+	p.persistRequest(PersistRequest{shards: []map[string]Entry{dict}, delta: &Delta{Entries: map[string]Entry{"key2": dict["key2"]}}})
+
+	restored, err := p.RestoreFromPersistance()
+	if err != nil || len(restored) != 2 || restored["key2"].Value != "changed" || restored["key3"].Value != "value3" {
+		t.Errorf("---> TEST: Got %v, err:%v", restored, err)
+	}
+	infos, _ := p.ListSnapshots()
+	if len(infos) != 1 || infos[0].Deltas != 2 {
+		t.Errorf("---> TEST: Expected a snapshot with 2 deltas, got %v", infos)
+	}
+
+	// a corrupted delta stops replay, the state up to the previous delta is restored
+	last := filepath.Join(config.Dir, strings.TrimSuffix(filepath.Base(base.Filename), ".json")+"-2.delta.json")
+	os.WriteFile(last, []byte("garbage"), 0644)
+	restored, err = p.RestoreFromPersistance()
+	if err != nil || len(restored) != 2 || restored["key2"].Value != "value2" {
+		t.Errorf("---> TEST: Got %v, err:%v", restored, err)
+	}
+
+	// the limit is reached, next persist is a full snapshot and retention deletes the old chain
+	time.Sleep(2 * time.Millisecond)
+	dict["key4"] = Entry{Value: "value4"}
+	next := p.persistRequest(PersistRequest{shards: []map[string]Entry{dict}, delta: &Delta{Entries: map[string]Entry{"key4": dict["key4"]}}})
+	if next.Filename == base.Filename || strings.Contains(next.Filename, ".delta.") {
+		t.Errorf("---> TEST: Got %v, expected a full snapshot", next.Filename)
+	}
+	files, _ := os.ReadDir(config.Dir)
+	if len(files) != 1 {
+		t.Errorf("---> TEST: Old snapshot and its deltas must be deleted, got %v files", len(files))
+	}
+}
+
+func TestTakeDelta(t *testing.T) {
+	s := Store{shards: []*shard{newShard(), newShard()}, cleared: true}
+	if s.takeDelta() != nil {
+		t.Errorf("---> TEST: The first persist must be full")
+	}
+	s.commit(map[string]Entry{"key1": s.entry("value1", 0, time.Now())})
+	s.commit(map[string]Entry{"key2": s.entry("value2", 0, time.Now())})
+	s.shardOf("key2").remove("key2")
+	delta := s.takeDelta()
+	if delta == nil || len(delta.Entries) != 1 || delta.Entries["key1"].Value != "value1" || len(delta.Deleted) != 1 || delta.Deleted[0] != "key2" {
+		t.Errorf("---> TEST: Got %v, expected key1 written and key2 deleted", delta)
+	}
+	if delta = s.takeDelta(); delta == nil || len(delta.Entries) != 0 || len(delta.Deleted) != 0 {
+		t.Errorf("---> TEST: Got %v, expected an empty delta", delta)
+	}
+	s.commit(map[string]Entry{"key3": s.entry("value3", 0, time.Now())})
+	s.cleared = true // set by delete all and restore
+	if delta = s.takeDelta(); delta != nil {
+		t.Errorf("---> TEST: Got %v, expected a full persist after the dict is cleared", delta)
+	}
+}
+
+// TestPersistDuringWrites persists while keys are written, run with -race to detect the dict shared with persistance
+func TestPersistDuringWrites(t *testing.T) {
+	config := PersistanceConfig{Dir: t.TempDir(), Prefix: "COW", KeepLast: 2}
+	s := openStore(t, Options{Interval: 300, Persistance: config})
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		s.Create(ctx, map[string]string{"key" + strconv.Itoa(i): "value"}, 0)
+	}
+
+	stop := make(chan bool)
+	written := make(chan int)
+	go func() {
+		n := 0
+		for ; ; n++ {
+			select {
+			case <-stop:
+				written <- n
+				return
+			default:
+				s.Set(ctx, "key"+strconv.Itoa(n%200), strconv.Itoa(n), SetOptions{Upsert: true})
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := s.Snapshot(ctx); err != nil {
+			t.Errorf("---> TEST: Snapshot failed. err:%v", err)
+		}
+	}
+	close(stop)
+	log.Printf("---> TEST: %v writes during snapshots", <-written)
+
+	// each snapshot is a consistent view, the latest one has at least the keys written before
+	dict, err := NewPersistance(300, config).RestoreFromPersistance()
+	if err != nil || len(dict) < 100 {
+		t.Errorf("---> TEST: Got %v keys, err:%v", len(dict), err)
+	}
+}
@@ -0,0 +1,378 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy defines when the write ahead log is flushed to disk
+type FsyncPolicy string
+
+const (
+	FSYNC_ALWAYS   FsyncPolicy = "always"   // fsync before each ack, an acknowledged write is never lost
+	FSYNC_EVERYSEC FsyncPolicy = "everysec" // fsync once a second, up to a second of writes may be lost on power failure
+	FSYNC_NEVER    FsyncPolicy = "never"    // flushing is left to the operating system
+)
+
+const DEFAULT_FSYNC_POLICY = FSYNC_EVERYSEC
+
+// ParseFsyncPolicy validates a policy name, empty name gives DEFAULT_FSYNC_POLICY
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(strings.ToLower(name)); policy {
+	case "":
+		return DEFAULT_FSYNC_POLICY, nil
+	case FSYNC_ALWAYS, FSYNC_EVERYSEC, FSYNC_NEVER:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %v, expected always, everysec or never", name)
+	}
+}
+
+// Write ahead log record operations
+const (
+	WAL_SET   = "set"   // entries are written
+	WAL_DEL   = "del"   // keys are deleted
+	WAL_CLEAR = "clear" // all keys are deleted
+	WAL_RESET = "reset" // all keys are replaced with entries
+)
+
+// WalRecord is a line of the write ahead log, a record is applied as a whole
+// Entries are logged with their versions and expiration times, so replay rebuilds the same dict
+// Version is the version counter of Store when the record is written, so replay restores the counter after deletes too
+type WalRecord struct {
+	Op      string           `json:"op"`
+	Entries map[string]Entry `json:"entries,omitempty"`
+	Keys    []string         `json:"keys,omitempty"`
+	Version uint64           `json:"version,omitempty"`
+}
+
+// WriteAheadLog is an append only log of the changes on the dict since the latest snapshot
+// Store appends a record for each write before acknowledging it, then a crash loses no acknowledged write
+// Log is split in segment files <prefix>-wal-<seq>.log, a new segment is started at each persistance tick
+// Segments are deleted after a snapshot covering them is persisted
+// On startup segments are replayed over the restored snapshot
+type WriteAheadLog struct {
+	dir     string
+	prefix  string
+	policy  FsyncPolicy
+	mu      sync.Mutex // Append and Rotate are called by the listener, Sync by fsync routine and Truncate by persistance
+	file    segmentFile
+	size    int64  // length of the complete records of the current segment
+	seq     uint64 // sequence of the current segment
+	written bool   // current segment has records
+	dirty   bool   // current segment has records not synced yet
+	keyring *Keyring
+	stop    chan struct{} // closed by Close to stop fsync routine
+}
+
+// segmentFile is the file of the current segment, *os.File opened for appending
+type segmentFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Truncate(size int64) error
+}
+
+// NewWriteAheadLog opens a new segment after the existing segments with given file prefix in dir
+// Existing segments are kept to be replayed
+// keyring encrypts records if it is not nil, each record is written as a base64 line; plain records are still replayed
+func NewWriteAheadLog(dir string, prefix string, policy FsyncPolicy, keyring *Keyring) (*WriteAheadLog, error) {
+	var w WriteAheadLog
+	w.dir = dir
+	w.prefix = prefix
+	w.policy = policy
+	w.keyring = keyring
+	w.stop = make(chan struct{})
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1]
+	}
+	if err := w.open(w.seq + 1); err != nil {
+		return nil, err
+	}
+	if policy == FSYNC_EVERYSEC {
+		go w.syncEverySecond()
+	}
+	return &w, nil
+}
+
+// syncEverySecond flushes the current segment once a second until the log is closed
+func (w *WriteAheadLog) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sync()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// filename gives the file of a segment
+func (w *WriteAheadLog) filename(seq uint64) string {
+	return filepath.Join(w.dir, w.prefix+"-wal-"+strconv.FormatUint(seq, 10)+".log")
+}
+
+// segments lists sequences of segment files in order
+func (w *WriteAheadLog) segments() ([]uint64, error) {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("WARNING Cannot read wal directory %v. err:%v\r\n", w.dir, err)
+		return nil, err
+	}
+	var segments []uint64
+	for _, v := range files {
+		if strings.HasPrefix(v.Name(), w.prefix+"-wal-") && strings.HasSuffix(v.Name(), ".log") && !v.IsDir() {
+			seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(v.Name(), w.prefix+"-wal-"), ".log"), 10, 64)
+			if err == nil {
+				segments = append(segments, seq)
+			}
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// open creates segment file of given sequence as the current segment
+func (w *WriteAheadLog) open(seq uint64) error {
+	file, err := os.OpenFile(w.filename(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		log.Printf("ERROR Cannot open wal segment %v. err:%v\r\n", w.filename(seq), err)
+		return err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = size
+	w.seq = seq
+	w.written = false
+	w.dirty = false
+	return nil
+}
+
+// Append writes a record to the current segment, syncs it to disk if policy is always
+func (w *WriteAheadLog) Append(record WalRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if w.keyring != nil {
+		buf = []byte(base64.StdEncoding.EncodeToString(w.keyring.Seal(buf)))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.file.Write(append(buf, '\n'))
+	if err != nil {
+		if n > 0 {
+			w.discard()
+		}
+		return err
+	}
+	w.size += int64(n)
+	w.written = true
+	w.dirty = true
+	if w.policy == FSYNC_ALWAYS {
+		w.dirty = false
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// discard removes the torn bytes of a failed append, so records appended later follow a complete record
+// Replay skips the rest of a segment after a broken record, the log goes on with a new segment if the bytes cannot be removed
+func (w *WriteAheadLog) discard() {
+	err := w.file.Truncate(w.size)
+	if err == nil {
+		return
+	}
+	log.Printf("ERROR Cannot truncate wal segment %v, a new segment is started. err:%v\r\n", w.filename(w.seq), err)
+	w.file.Close()
+	w.open(w.seq + 1)
+}
+
+// Sync flushes the current segment to disk if it has unsynced records
+func (w *WriteAheadLog) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// Rotate closes the current segment and starts a new one, returns the sequence of the last closed segment
+// All records until the rotation are in segments up to the returned sequence
+// Current segment is kept if it has no records
+func (w *WriteAheadLog) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.written {
+		return w.seq - 1, nil
+	}
+	seq := w.seq
+	w.file.Sync()
+	w.file.Close()
+	return seq, w.open(seq + 1)
+}
+
+// Truncate deletes segments up to given sequence, they are not needed after a snapshot covering them
+func (w *WriteAheadLog) Truncate(upTo uint64) {
+	segments, err := w.segments()
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	current := w.seq
+	w.mu.Unlock()
+	for _, seq := range segments {
+		if seq <= upTo && seq != current {
+			if err := os.Remove(w.filename(seq)); err != nil {
+				log.Printf("ERROR Cannot delete wal segment %v. err:%v\r\n", w.filename(seq), err)
+			}
+		}
+	}
+}
+
+// Replay applies records of segments before the current segment on dict, returns the number of applied records
+// and the highest version counter of the records
+// A broken record is the torn tail of a segment written at a crash, the rest of that segment is skipped and replay goes on
+// with the next segment since a segment is started after the previous one is closed. Entries expired are dropped
+// A record encrypted with a key which is not in the keyring stops replay with ErrWrongKey
+func (w *WriteAheadLog) Replay(dict map[string]Entry) (int, uint64, error) {
+	segments, err := w.segments()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 0
+	var version uint64
+	for _, seq := range segments {
+		if seq >= w.seq {
+			break
+		}
+		var applied int
+		applied, err = w.replaySegment(seq, dict, &version)
+		n += applied
+		if err != nil {
+			break
+		}
+	}
+	now := time.Now()
+	for k, e := range dict {
+		if e.Expired(now) {
+			delete(dict, k)
+		}
+	}
+	return n, version, err
+}
+
+// replaySegment applies records of a segment on dict until a broken record, only ErrWrongKey and open errors are returned
+// version is raised to the version counter of the applied records
+func (w *WriteAheadLog) replaySegment(seq uint64, dict map[string]Entry, version *uint64) (int, error) {
+	file, err := os.Open(w.filename(seq))
+	if err != nil {
+		log.Printf("ERROR Cannot open wal segment %v. err:%v\r\n", w.filename(seq), err)
+		return 0, err
+	}
+	defer file.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<30)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) > 0 && line[0] != '{' {
+			// encrypted record
+			sealed, err := base64.StdEncoding.DecodeString(string(line))
+			if err == nil {
+				line, err = w.keyring.Open(sealed)
+			}
+			if errors.Is(err, ErrWrongKey) {
+				log.Printf("ERROR Cannot decrypt wal segment %v, replay stopped. err:%v\r\n", w.filename(seq), err)
+				return n, err
+			} else if err != nil {
+				log.Printf("WARNING Broken record in wal segment %v, rest of the segment is skipped. err:%v\r\n", w.filename(seq), err)
+				return n, nil
+			}
+		}
+		var record WalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("WARNING Broken record in wal segment %v, rest of the segment is skipped. err:%v\r\n", w.filename(seq), err)
+			return n, nil
+		}
+		if err := record.Apply(dict); err != nil {
+			log.Printf("WARNING Broken record in wal segment %v, rest of the segment is skipped. err:%v\r\n", w.filename(seq), err)
+			return n, nil
+		}
+		if record.Version > *version {
+			*version = record.Version
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("WARNING Cannot read wal segment %v, rest of the segment is skipped. err:%v\r\n", w.filename(seq), err)
+	}
+	return n, nil
+}
+
+// Apply performs the record on dict
+func (r WalRecord) Apply(dict map[string]Entry) error {
+	switch r.Op {
+	case WAL_SET:
+		for k, e := range r.Entries {
+			dict[k] = e
+		}
+	case WAL_DEL:
+		for _, k := range r.Keys {
+			delete(dict, k)
+		}
+	case WAL_CLEAR:
+		for k := range dict {
+			delete(dict, k)
+		}
+	case WAL_RESET:
+		for k := range dict {
+			delete(dict, k)
+		}
+		for k, e := range r.Entries {
+			dict[k] = e
+		}
+	default:
+		return errors.New("unknown wal operation " + r.Op)
+	}
+	return nil
+}
+
+// Close stops fsync routine, syncs and closes the current segment
+func (w *WriteAheadLog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	w.dirty = false
+	w.file.Sync()
+	return w.file.Close()
+}
@@ -0,0 +1,205 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWalReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_ALWAYS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"A": {Value: "1", Version: 1}, "B": {Value: "2", Version: 2}}})
+	wal.Append(WalRecord{Op: WAL_DEL, Keys: []string{"A"}})
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"C": {Value: "3", Version: 3, ExpiresAt: time.Now().Add(-time.Second).UnixMilli()}}})
+	wal.Close()
+
+	// broken last record of a crash must not prevent replay
+	f, _ := os.OpenFile(wal.filename(wal.seq), os.O_WRONLY|os.O_APPEND, 0660)
+	f.WriteString(`{"op":"set","entr`)
+	f.Close()
+
+	wal2, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal2.Close()
+	dict := make(map[string]Entry)
+	n, _, _ := wal2.Replay(dict)
+	if n != 3 || len(dict) != 1 || dict["B"] != (Entry{Value: "2", Version: 2}) {
+		t.Errorf("---> TEST: Replayed %v records, dict is wrong: %v", n, dict)
+	}
+}
+
+func TestWalReplayTornSegment(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"A": {Value: "1", Version: 1}}})
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"B": {Value: "2", Version: 2}}})
+	first := wal.seq
+	wal.Rotate()
+	wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"C": {Value: "3", Version: 3}}})
+	wal.Close()
+
+	// the first segment is torn in the middle of its last record
+	info, _ := os.Stat(wal.filename(first))
+	os.Truncate(wal.filename(first), info.Size()-10)
+
+	wal2, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal2.Close()
+	dict := make(map[string]Entry)
+	n, _, err := wal2.Replay(dict)
+	if err != nil || n != 2 || len(dict) != 2 || dict["A"].Value != "1" || dict["C"].Value != "3" {
+		t.Errorf("---> TEST: Replayed %v records, dict: %v, err:%v, expected A and C", n, dict, err)
+	}
+}
+
+// tornFile writes half of the next record and fails, as a full disk does
+type tornFile struct {
+	segmentFile
+	truncate bool // Truncate works, otherwise it fails too
+	torn     bool
+}
+
+func (f *tornFile) Write(p []byte) (int, error) {
+	if f.torn {
+		return f.segmentFile.Write(p)
+	}
+	f.torn = true
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f *tornFile) Truncate(size int64) error {
+	if !f.truncate {
+		return errors.New("truncate failed")
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+func TestWalPartialAppend(t *testing.T) {
+	// torn bytes are truncated, or the log goes on with a new segment if they cannot be
+	for _, truncate := range []bool{true, false} {
+		dir := t.TempDir()
+		wal, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_ALWAYS, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"A": {Value: "1", Version: 1}}})
+		wal.file = &tornFile{segmentFile: wal.file, truncate: truncate}
+		if err := wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"B": {Value: "2", Version: 2}}}); err == nil {
+			t.Errorf("---> TEST: Partial append must fail")
+		}
+		wal.Append(WalRecord{Op: WAL_SET, Entries: map[string]Entry{"C": {Value: "3", Version: 3}}})
+		wal.Close()
+
+		wal2, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := make(map[string]Entry)
+		n, _, err := wal2.Replay(dict)
+		wal2.Close()
+		if err != nil || n != 2 || len(dict) != 2 || dict["A"].Value != "1" || dict["C"].Value != "3" {
+			t.Errorf("---> TEST: Truncate %v replayed %v records, dict: %v, err:%v, expected A and C", truncate, n, dict, err)
+		}
+	}
+}
+
+func TestWalRotateAndTruncate(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWriteAheadLog(dir, DEFAULT_FILE_PREFIX, FSYNC_NEVER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if seq, _ := wal.Rotate(); seq != 0 {
+		t.Errorf("---> TEST: Empty segment must not be rotated. Got %v", seq)
+	}
+	wal.Append(WalRecord{Op: WAL_CLEAR})
+	seq, _ := wal.Rotate()
+	wal.Append(WalRecord{Op: WAL_CLEAR})
+	wal.Truncate(seq)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "GOAPP-wal-*.log"))
+	if len(files) != 1 || files[0] != wal.filename(seq+1) {
+		t.Errorf("---> TEST: Only the current segment must be kept. Got %v", files)
+	}
+}
+
+/* Store and write ahead log tests */
+func TestWriteFailsIfNotJournaled(t *testing.T) {
+	s := openStore(t, Options{Interval: 300, Fsync: FSYNC_ALWAYS, Persistance: PersistanceConfig{Dir: t.TempDir(), Prefix: "JOURNAL", KeepLast: 2}})
+	ctx := context.Background()
+	s.Set(ctx, "key1", "value1", SetOptions{Upsert: true})
+	s.wal.file.Close() // appends fail from now on
+
+	if _, _, err := s.Set(ctx, "key1", "value2", SetOptions{}); !errors.Is(err, ErrJournalFailed) {
+		t.Errorf("---> TEST: Set got %v, expected %v", err, ErrJournalFailed)
+	}
+	if err := s.Delete(ctx, "key1"); !errors.Is(err, ErrJournalFailed) {
+		t.Errorf("---> TEST: Delete got %v, expected %v", err, ErrJournalFailed)
+	}
+	if _, err := s.Create(ctx, map[string]string{"key2": "value2"}, 0); !errors.Is(err, ErrJournalFailed) {
+		t.Errorf("---> TEST: Create got %v, expected %v", err, ErrJournalFailed)
+	}
+	if err := s.DeleteAll(ctx); !errors.Is(err, ErrJournalFailed) {
+		t.Errorf("---> TEST: DeleteAll got %v, expected %v", err, ErrJournalFailed)
+	}
+	// failed writes change nothing
+	page, _ := s.Scan(ctx, "", "", 10)
+	if len(page.Keys) != 1 || page.Entries["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Failed writes are applied, got %v", page.Entries)
+	}
+}
+
+func TestSetSurvivesRestart(t *testing.T) {
+	s := openStore(t, Options{Interval: 300, Fsync: FSYNC_ALWAYS})
+	if _, _, err := s.Set(context.Background(), "walkey1", "value1", SetOptions{Upsert: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart without waiting for persistance tick
+	s2 := openStore(t, Options{Interval: 300})
+	if e, err := s2.Get(context.Background(), "walkey1"); err != nil || e.Value != "value1" {
+		t.Errorf("---> TEST: Got %v, err:%v", e, err)
+	}
+}
+
+func TestVersionSurvivesDelete(t *testing.T) {
+	for _, backend := range []string{BACKEND_JSON, BACKEND_BTREE} {
+		config := PersistanceConfig{Dir: t.TempDir(), Prefix: "VERSION", KeepLast: 2, Backend: backend}
+		ctx := context.Background()
+		s := openStore(t, Options{Interval: 300, Fsync: FSYNC_ALWAYS, Persistance: config})
+		s.Set(ctx, "key1", "value1", SetOptions{Upsert: true})
+		s.Set(ctx, "key2", "value2", SetOptions{Upsert: true})
+		deleted, _ := s.Get(ctx, "key2")
+		s.Delete(ctx, "key2")
+
+		// restart without a snapshot, the counter is replayed from write ahead log
+		s2 := openStore(t, Options{Interval: 300, Fsync: FSYNC_ALWAYS, Persistance: config})
+		if stats, _ := s2.Stats(ctx); stats.Version != deleted.Version {
+			t.Errorf("---> TEST: %v backend replayed version %v, expected %v", backend, stats.Version, deleted.Version)
+		}
+		s2.Close(ctx)
+
+		// restart after the final snapshot, the counter is restored from the snapshot
+		s3 := openStore(t, Options{Interval: 300, Persistance: config})
+		if e, _, err := s3.CompareAndSwap(ctx, "key2", nil, "value3", 0); err != nil || e.Version <= deleted.Version {
+			t.Errorf("---> TEST: %v backend gave version %v after restart, deleted key had %v. err:%v", backend, e.Version, deleted.Version, err)
+		}
+		s3.Close(ctx)
+	}
+}
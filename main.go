@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"goapp/kvstore"
 )
 
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 // in seconds
+
 // @title GOAPP API documentation
 // @description In memory key-value store
 // @version 1.0.0
@@ -20,8 +31,161 @@ func main() {
 		port = "8080"
 	}
 
-	s := NewService()
+	// Get write ahead log fsync policy from env or default everysec
+	policy, err := kvstore.ParseFsyncPolicy(os.Getenv("WAL_FSYNC"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := persistanceConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Get shutdown timeout in seconds from env or default 30
+	timeout := DEFAULT_SHUTDOWN_TIMEOUT
+	if t := os.Getenv("SHUTDOWN_TIMEOUT"); len(t) > 0 {
+		timeout, err = strconv.Atoi(t)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("SHUTDOWN_TIMEOUT must be a positive number of seconds, got %v", t)
+		}
+	}
+
+	// Get operation timeout in seconds from env or default 10
+	operationTimeout := DEFAULT_OPERATION_TIMEOUT
+	if t := os.Getenv("OPERATION_TIMEOUT"); len(t) > 0 {
+		operationTimeout, err = strconv.Atoi(t)
+		if err != nil || operationTimeout <= 0 {
+			log.Fatalf("OPERATION_TIMEOUT must be a positive number of seconds, got %v", t)
+		}
+	}
+
+	shards := 0
+	if n := os.Getenv("STORE_SHARDS"); len(n) > 0 {
+		if shards, err = strconv.Atoi(n); err != nil || shards <= 0 {
+			log.Fatalf("STORE_SHARDS must be a positive number, got %v", n)
+		}
+	}
+	storeConfig, err := kvstore.ParseStoreConfig(os.Getenv("STORE_ENGINE"), shards)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := NewService(policy, config, storeConfig, time.Duration(operationTimeout)*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
 	http.HandleFunc("/", s.Handle)
-	log.Printf("GOAPP listenting at :%v\r\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+
+	// Start RESP listener if RESP_PORT is given, Redis clients share the store with the REST API
+	var resp *RespServer
+	if respPort := os.Getenv("RESP_PORT"); len(respPort) > 0 {
+		listener, err := net.Listen("tcp", ":"+respPort)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp = NewRespServer(s)
+		go func() {
+			log.Printf("GOAPP RESP listening at :%v\r\n", respPort)
+			if err := resp.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("GOAPP listenting at :%v\r\n", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for SIGTERM (docker stop, heroku) or SIGINT, then stop accepting requests,
+	// wait in-flight requests and persist the final dict
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	log.Printf("INFO Received %v, shutting down in %v seconds\r\n", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("ERROR HTTP server shutdown failed. err:%v\r\n", err)
+	}
+	if resp != nil {
+		if err := resp.Shutdown(ctx); err != nil {
+			log.Printf("ERROR RESP server shutdown failed. err:%v\r\n", err)
+		}
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("ERROR Service shutdown failed. err:%v\r\n", err)
+		os.Exit(1)
+	}
+	log.Printf("INFO GOAPP stopped\r\n")
+}
+
+// persistanceConfigFromEnv reads data directory, file prefix, snapshot retention, backend, compression and encryption keys from env
+// DATA_DIR, FILE_PREFIX, SNAPSHOT_KEEP_LAST, SNAPSHOT_KEEP_HOURS, SNAPSHOT_DELTA_LIMIT, PERSISTANCE_BACKEND, SNAPSHOT_COMPRESSION override the defaults
+// ENCRYPTION_KEY (with optional ENCRYPTION_KEY_ID) and ENCRYPTION_KEY_FILE enable encryption
+func persistanceConfigFromEnv() (kvstore.PersistanceConfig, error) {
+	config := kvstore.DefaultPersistanceConfig()
+	if dir := os.Getenv("DATA_DIR"); len(dir) > 0 {
+		config.Dir = dir
+	}
+	if prefix := os.Getenv("FILE_PREFIX"); len(prefix) > 0 {
+		config.Prefix = prefix
+	}
+	if keepLast := os.Getenv("SNAPSHOT_KEEP_LAST"); len(keepLast) > 0 {
+		n, err := strconv.Atoi(keepLast)
+		if err != nil || n < 1 {
+			return config, fmt.Errorf("SNAPSHOT_KEEP_LAST must be a positive number, got %v", keepLast)
+		}
+		config.KeepLast = n
+	}
+	if deltaLimit := os.Getenv("SNAPSHOT_DELTA_LIMIT"); len(deltaLimit) > 0 {
+		n, err := strconv.Atoi(deltaLimit)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("SNAPSHOT_DELTA_LIMIT must be a non negative number, got %v", deltaLimit)
+		}
+		config.DeltaLimit = n
+	}
+	if backend := os.Getenv("PERSISTANCE_BACKEND"); len(backend) > 0 {
+		switch backend {
+		case kvstore.BACKEND_JSON, kvstore.BACKEND_BTREE, kvstore.BACKEND_MEMORY:
+			config.Backend = backend
+		default:
+			return config, fmt.Errorf("PERSISTANCE_BACKEND must be json, btree or memory, got %v", backend)
+		}
+	}
+	compression, err := kvstore.ParseCompression(os.Getenv("SNAPSHOT_COMPRESSION"))
+	if err != nil {
+		return config, err
+	}
+	config.Compression = compression
+	if keyFile := os.Getenv("ENCRYPTION_KEY_FILE"); len(keyFile) > 0 {
+		if config.Keyring, err = kvstore.LoadKeyringFile(keyFile); err != nil {
+			return config, err
+		}
+	}
+	if key := os.Getenv("ENCRYPTION_KEY"); len(key) > 0 {
+		// the key given in env is the current key, keys of the key file are kept to read older files
+		if config.Keyring == nil {
+			config.Keyring = kvstore.NewKeyring()
+		}
+		k, err := kvstore.ParseKey(key)
+		if err == nil {
+			err = config.Keyring.Add(os.Getenv("ENCRYPTION_KEY_ID"), k)
+		}
+		if err != nil {
+			return config, fmt.Errorf("ENCRYPTION_KEY is invalid: %v", err)
+		}
+	}
+	if keepHours := os.Getenv("SNAPSHOT_KEEP_HOURS"); len(keepHours) > 0 {
+		hours, err := strconv.ParseFloat(keepHours, 64)
+		if err != nil || hours < 0 {
+			return config, fmt.Errorf("SNAPSHOT_KEEP_HOURS must be a non negative number, got %v", keepHours)
+		}
+		config.KeepFor = time.Duration(hours * float64(time.Hour))
+	}
+	return config, nil
 }
@@ -2,47 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"path/filepath"
 	"testing"
 	"time"
-)
-
-func TestPersist(t *testing.T) {
-	pers := NewPersistance(30)
-	dict := map[string]string{"A": "1", "B": "2", "C": "3", "D": "4"}
-	filename := pers.Persist(&dict)
-	if filename == "" {
-		t.Errorf("---> TEST: Cannot create file")
-	}
-	err := os.Remove(filename)
-	if err != nil {
-		t.Errorf("---> TEST: Cannot delete created file (%v) in test case. err:%v", filename, err)
-	} else {
-		log.Printf("---> TEST: file '%v' deleted after test case", filename)
-	}
-}
-
-func TestRestore(t *testing.T) {
-	pers := NewPersistance(30)
-	dict := map[string]string{"A": "1", "B": "2", "C": "3", "D": "4"}
-	filename := pers.Persist(&dict)
-	if filename == "" {
-		t.Errorf("---> TEST: Cannot create file")
-	}
 
-	dict, err := pers.RestoreFromPersistance()
-	if err != nil {
-		t.Errorf("---> TEST: Data recovered from tmp directory. dict.len:%v \r\n", len(dict))
-	}
-}
+	"goapp/kvstore"
+)
 
 /* Service and Persistance tests */
 func TestCreatePersists(t *testing.T) {
-	s := NewService(1) // create a service with 3 seconds persistance interval
+	s := newService(t, 1) // create a service with 3 seconds persistance interval
 	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"key1": "value1"}`)))
 	req.Header.Add("content-type", "application/json")
 	if _err != nil {
@@ -55,7 +29,7 @@ func TestCreatePersists(t *testing.T) {
 
 	// wait for 3 seconds
 	time.Sleep(3 * time.Second)
-	s2 := NewService(300) // create another service, restart app
+	s2 := newService(t, 300) // create another service, restart app
 
 	// get the previosly created and persisted key1
 	req2, _err2 := http.NewRequest("GET", "/api/v1/my/keys/key1", nil)
@@ -82,3 +56,47 @@ func TestCreatePersists(t *testing.T) {
 		t.Errorf("---> TEST: Response payload is wrong: %v", result)
 	}
 }
+
+func TestAdminSnapshotAndRestore(t *testing.T) {
+	config := kvstore.PersistanceConfig{Dir: t.TempDir(), Prefix: "ADMIN", KeepLast: 5}
+	s := newService(t, 300, config)
+
+	serve(t, s, "POST", "/api/v1/my/keys", `{"key1": "value1"}`)
+	rr := serve(t, s, "POST", "/admin/snapshot", "")
+	var info kvstore.SnapshotInfo
+	if rr.Code != http.StatusCreated || json.Unmarshal(rr.Body.Bytes(), &info) != nil || info.Filename == "" || info.Hash == "" {
+		t.Fatalf("---> TEST: Snapshot failed. Got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// change the dict after the snapshot
+	serve(t, s, "DELETE", "/api/v1/my/keys", "")
+	serve(t, s, "POST", "/api/v1/my/keys", `{"key2": "value2"}`)
+
+	rr = serve(t, s, "GET", "/admin/snapshots", "")
+	var infos []kvstore.SnapshotInfo
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &infos) != nil || len(infos) != 1 || infos[0].Hash != info.Hash || infos[0].Size == 0 {
+		t.Errorf("---> TEST: Snapshots failed. Got %v %v, expected %v", rr.Code, rr.Body.String(), info)
+	}
+
+	if rr = serve(t, s, "POST", "/admin/restore", `{"filename": "ADMIN-1.json"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("---> TEST: Restore of unknown file got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+	if rr = serve(t, s, "POST", "/admin/restore", `{"filename": "`+filepath.Base(info.Filename)+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("---> TEST: Restore failed. Got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = serve(t, s, "GET", "/api/v1/my/keys/key1", ""); rr.Code != http.StatusOK {
+		t.Errorf("---> TEST: Restored key got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if rr = serve(t, s, "GET", "/api/v1/my/keys/key2", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("---> TEST: Key written after snapshot got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+
+	// restore is journaled, it survives a restart before the next snapshot
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	dict, err := kvstore.NewPersistance(300, config).RestoreFromPersistance()
+	if _, ok := dict["key2"]; err != nil || ok || dict["key1"].Value != "value1" {
+		t.Errorf("---> TEST: Restored dict is not persisted. Got %v, err:%v", dict, err)
+	}
+}
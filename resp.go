@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goapp/kvstore"
+)
+
+// RESP listener serves the store to Redis clients, it is started when RESP_PORT is given
+
+const RESP_MAX_BULK = 512 * 1024 * 1024 // max length of a bulk string in a command, same as proto-max-bulk-len of Redis
+const RESP_MAX_ARGS = 1024 * 1024       // max number of arguments of a command
+const RESP_MAX_INLINE = 64 * 1024       // max length of an inline command, also the read buffer of a connection
+const RESP_PREALLOC_ARGS = 1024         // arguments allocated before they arrive, more arguments grow the slice
+const RESP_MAX_CURSORS = 10000          // SCAN cursors kept, the oldest cursor is forgotten first
+const RESP_SCAN_COUNT = 10              // default COUNT of SCAN
+
+// errProtocol is returned when a client does not speak RESP, the connection is closed after the error is replied
+var errProtocol = errors.New("Protocol error")
+
+// RespServer serves GET, SET, DEL, EXISTS, KEYS, SCAN, INCR, EXPIRE, TTL, FLUSHALL and PING over RESP2 and RESP3
+// Commands are executed by the same store as the REST API, each with the operation timeout of the service
+// SCAN cursors are numbers as clients expect, each one is mapped to the last key of its page in cursors
+// A connection speaks RESP2 until it sends HELLO 3
+type RespServer struct {
+	store    *kvstore.Store
+	timeout  time.Duration
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+	lastId   int64
+	cursors  map[uint64]string
+	order    []uint64 // cursor ids in creation order
+	cursorId uint64
+}
+
+// NewRespServer creates a RESP server of the store of given service
+func NewRespServer(s *ServiceX) *RespServer {
+	return &RespServer{store: s.store, timeout: s.timeout, conns: make(map[net.Conn]bool), cursors: make(map[uint64]string)}
+}
+
+// Serve accepts connections until Shutdown, each connection is served in its own go routine
+func (rs *RespServer) Serve(l net.Listener) error {
+	rs.mu.Lock()
+	rs.listener = l
+	closed := rs.closed
+	rs.mu.Unlock()
+	if closed {
+		l.Close()
+		return nil
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			rs.mu.Lock()
+			closed := rs.closed
+			rs.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		rs.mu.Lock()
+		if rs.closed {
+			rs.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		rs.conns[conn] = true
+		rs.lastId++
+		id := rs.lastId
+		rs.wg.Add(1)
+		rs.mu.Unlock()
+		go rs.serve(conn, id)
+	}
+}
+
+// Shutdown stops accepting connections and closes each connection once its current command is replied
+// Returns ctx error if connections are not closed in time
+func (rs *RespServer) Shutdown(ctx context.Context) error {
+	rs.mu.Lock()
+	rs.closed = true
+	if rs.listener != nil {
+		rs.listener.Close()
+	}
+	for conn := range rs.conns {
+		conn.SetReadDeadline(time.Now()) // a blocked read returns, a command in progress is replied first
+	}
+	rs.mu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		rs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// respConn is a client connection, proto is the RESP version replied
+type respConn struct {
+	id    int64
+	proto int
+	r     *bufio.Reader
+	w     *bufio.Writer
+}
+
+// serve reads commands and replies them in order, replies of pipelined commands are flushed together
+func (rs *RespServer) serve(conn net.Conn, id int64) {
+	defer rs.wg.Done()
+	defer func() {
+		rs.mu.Lock()
+		delete(rs.conns, conn)
+		rs.mu.Unlock()
+		conn.Close()
+	}()
+	log.Printf("INFO RESP connection accepted. Id:%v RemoteAddr:%v\r\n", id, conn.RemoteAddr())
+
+	c := respConn{id: id, proto: 2, r: bufio.NewReaderSize(conn, RESP_MAX_INLINE), w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(c.r)
+		if errors.Is(err, errProtocol) {
+			c.error("ERR " + err.Error())
+			c.w.Flush()
+			log.Printf("WARN RESP connection closed. Id:%v err:%v\r\n", id, err)
+			return
+		} else if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					log.Printf("WARN RESP connection failed. Id:%v err:%v\r\n", id, err)
+				}
+			}
+			log.Printf("INFO RESP connection closed. Id:%v\r\n", id)
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := rs.execute(&c, args)
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			log.Printf("INFO RESP connection closed. Id:%v\r\n", id)
+			return
+		}
+	}
+}
+
+// readCommand reads a command as an array of bulk strings or as an inline command separated by spaces
+// An empty inline command gives no args
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	// the arguments and the bulk strings grow as they arrive, a length sent without data does not allocate
+	prealloc := n
+	if prealloc > RESP_PREALLOC_ARGS {
+		prealloc = RESP_PREALLOC_ARGS
+	}
+	args := make([]string, 0, prealloc)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		arg, err := readBulk(r, size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads a bulk string of given size and its CRLF terminator
+// The string is read in chunks of the read buffer, so memory grows with the received data instead of the announced size
+func readBulk(r *bufio.Reader, size int) (string, error) {
+	var b strings.Builder
+	if size <= RESP_MAX_INLINE {
+		b.Grow(size)
+	}
+	if _, err := io.CopyN(&b, r, int64(size)); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string is not terminated by CRLF", errProtocol)
+	}
+	return b.String(), nil
+}
+
+// readLine reads a line terminated by CRLF or LF, the terminator is dropped
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big inline request", errProtocol)
+	} else if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// Replies are written by the methods of respConn, RESP2 has no map and null types so they are written as array and null bulk string
+
+func (c *respConn) simple(s string) { c.w.WriteString("+" + s + "\r\n") }
+
+func (c *respConn) error(s string) { c.w.WriteString("-" + s + "\r\n") }
+
+func (c *respConn) integer(n int64) { c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n") }
+
+func (c *respConn) bulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) null() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+	} else {
+		c.w.WriteString("$-1\r\n")
+	}
+}
+
+func (c *respConn) array(n int) { c.w.WriteString("*" + strconv.Itoa(n) + "\r\n") }
+
+// hash writes the header of a map of n pairs, each pair is written as two replies
+func (c *respConn) hash(n int) {
+	if c.proto == 3 {
+		c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.array(2 * n)
+	}
+}
+
+func (c *respConn) list(values []string) {
+	c.array(len(values))
+	for _, v := range values {
+		c.bulk(v)
+	}
+}
+
+// failed replies a store error, gives false if there is no error
+func (c *respConn) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	c.error("ERR " + err.Error())
+	return true
+}
+
+// execute runs a command and writes its reply, gives true if the connection is closed by the command
+func (rs *RespServer) execute(c *respConn, args []string) bool {
+	name := strings.ToUpper(args[0])
+	// arity checks the number of args including the command name, zero maxArgs has no limit
+	arity := func(minArgs int, maxArgs int) bool {
+		if len(args) < minArgs || (maxArgs > 0 && len(args) > maxArgs) {
+			c.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+			return false
+		}
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rs.timeout)
+	defer cancel()
+
+	switch name {
+	case "PING":
+		if !arity(1, 2) {
+			break
+		}
+		if len(args) == 2 {
+			c.bulk(args[1])
+		} else {
+			c.simple("PONG")
+		}
+	case "HELLO":
+		rs.hello(c, args)
+	case "QUIT":
+		c.simple("OK")
+		return true
+	case "SELECT":
+		if !arity(2, 2) {
+			break
+		}
+		if args[1] != "0" {
+			c.error("ERR DB index is out of range")
+		} else {
+			c.simple("OK")
+		}
+	case "CLIENT":
+		// clients set their name and library on connect, names are not kept
+		if !arity(2, 0) {
+			break
+		}
+		if sub := strings.ToUpper(args[1]); sub == "SETNAME" || sub == "SETINFO" {
+			c.simple("OK")
+		} else if sub == "ID" {
+			c.integer(c.id)
+		} else {
+			c.error("ERR unknown subcommand '" + args[1] + "'")
+		}
+	case "COMMAND":
+		// redis-cli asks command docs for hints, there are none
+		c.array(0)
+	case "GET":
+		if !arity(2, 2) {
+			break
+		}
+		e, err := rs.store.Get(ctx, args[1])
+		if errors.Is(err, kvstore.ErrNotFound) {
+			c.null()
+		} else if !c.failed(err) {
+			c.bulk(e.Value)
+		}
+	case "SET":
+		rs.set(ctx, c, args)
+	case "DEL":
+		if !arity(2, 0) {
+			break
+		}
+		var n int64
+		for _, key := range args[1:] {
+			err := rs.store.Delete(ctx, key)
+			if err == nil {
+				n++
+			} else if !errors.Is(err, kvstore.ErrNotFound) {
+				c.failed(err)
+				return false
+			}
+		}
+		c.integer(n)
+	case "EXISTS":
+		if !arity(2, 0) {
+			break
+		}
+		var n int64
+		for _, key := range args[1:] {
+			_, err := rs.store.Get(ctx, key)
+			if err == nil {
+				n++
+			} else if !errors.Is(err, kvstore.ErrNotFound) {
+				c.failed(err)
+				return false
+			}
+		}
+		c.integer(n)
+	case "KEYS":
+		if !arity(2, 2) {
+			break
+		}
+		keys := []string{}
+		after := ""
+		for {
+			page, err := rs.store.Scan(ctx, literalPrefix(args[1]), after, MAX_LIST_LIMIT)
+			if c.failed(err) {
+				return false
+			}
+			for _, k := range page.Keys {
+				if globMatch(args[1], k) {
+					keys = append(keys, k)
+				}
+			}
+			if !page.More {
+				break
+			}
+			after = page.Keys[len(page.Keys)-1]
+		}
+		c.list(keys)
+	case "SCAN":
+		rs.scan(ctx, c, args)
+	case "INCR":
+		if !arity(2, 2) {
+			break
+		}
+		// a decimal value is refused by the store as Redis does, it is not incremented as a float
+		e, err := rs.store.IncrementInt(ctx, args[1], 1)
+		if errors.Is(err, kvstore.ErrNotNumber) {
+			c.error("ERR value is not an integer or out of range")
+		} else if !c.failed(err) {
+			if n, err := strconv.ParseInt(e.Value, 10, 64); err != nil {
+				c.error("ERR value is not an integer or out of range")
+			} else {
+				c.integer(n)
+			}
+		}
+	case "EXPIRE":
+		if !arity(3, 3) {
+			break
+		}
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || seconds > math.MaxInt64/int64(time.Second) {
+			c.error("ERR value is not an integer or out of range")
+			break
+		}
+		// a key expiring now is deleted
+		if seconds <= 0 {
+			err = rs.store.Delete(ctx, args[1])
+		} else {
+			_, err = rs.store.Expire(ctx, args[1], time.Duration(seconds)*time.Second)
+		}
+		if errors.Is(err, kvstore.ErrNotFound) {
+			c.integer(0)
+		} else if !c.failed(err) {
+			c.integer(1)
+		}
+	case "TTL":
+		if !arity(2, 2) {
+			break
+		}
+		e, err := rs.store.Get(ctx, args[1])
+		if errors.Is(err, kvstore.ErrNotFound) {
+			c.integer(-2)
+		} else if !c.failed(err) && e.ExpiresAt == 0 {
+			c.integer(-1)
+		} else if err == nil {
+			c.integer(int64((e.TTL(time.Now()) + time.Second/2) / time.Second))
+		}
+	case "FLUSHALL":
+		if arity(1, 2) && !c.failed(rs.store.DeleteAll(ctx)) {
+			c.simple("OK")
+		}
+	default:
+		c.error("ERR unknown command '" + args[0] + "'")
+	}
+	return false
+}
+
+// hello switches the protocol version of the connection and replies the server info
+// HELLO [protover [SETNAME name]], AUTH is refused since the server has no users
+func (rs *RespServer) hello(c *respConn, args []string) {
+	proto := c.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 2 || v > 3 {
+			c.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	for i := 2; i < len(args); i++ {
+		if strings.ToUpper(args[i]) == "SETNAME" && i+1 < len(args) {
+			i++
+			continue
+		}
+		c.error("ERR syntax error in HELLO option '" + args[i] + "'")
+		return
+	}
+	c.proto = proto
+	c.hash(7)
+	c.bulk("server")
+	c.bulk("goapp")
+	c.bulk("version")
+	c.bulk("1.0.0")
+	c.bulk("proto")
+	c.integer(int64(proto))
+	c.bulk("id")
+	c.integer(c.id)
+	c.bulk("mode")
+	c.bulk("standalone")
+	c.bulk("role")
+	c.bulk("master")
+	c.bulk("modules")
+	c.array(0)
+}
+
+// set runs SET key value [NX|XX] [EX seconds|PX milliseconds]
+// NX writes only if the key does not exist and XX only if it exists, a value not written is replied as null
+func (rs *RespServer) set(ctx context.Context, c *respConn, args []string) {
+	if len(args) < 3 {
+		c.error("ERR wrong number of arguments for 'set' command")
+		return
+	}
+	opts := kvstore.SetOptions{Upsert: true}
+	nx, xx := false, false
+	for i := 3; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == "NX" && !xx:
+			nx = true
+			opts.IfNoneMatch = "*"
+		case option == "XX" && !nx:
+			xx = true
+			opts.Upsert = false
+		case (option == "EX" || option == "PX") && opts.TTL == 0 && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			opts.TTL = time.Duration(n) * unit
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+	}
+	_, _, err := rs.store.Set(ctx, args[1], args[2], opts)
+	if errors.Is(err, kvstore.ErrPreconditionFailed) || errors.Is(err, kvstore.ErrNotFound) {
+		c.null()
+	} else if !c.failed(err) {
+		c.simple("OK")
+	}
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count] [TYPE type], all values are strings
+// A page has at most count keys before matching so it may be empty, cursor 0 starts and ends the iteration
+func (rs *RespServer) scan(ctx context.Context, c *respConn, args []string) {
+	if len(args) < 2 {
+		c.error("ERR wrong number of arguments for 'scan' command")
+		return
+	}
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		c.error("ERR invalid cursor")
+		return
+	}
+	pattern, count, typ := "*", RESP_SCAN_COUNT, "string"
+	for i := 2; i < len(args); i++ {
+		if i+1 >= len(args) {
+			c.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				c.error("ERR value is not an integer or out of range")
+				return
+			}
+			if count > MAX_LIST_LIMIT {
+				count = MAX_LIST_LIMIT
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			c.error("ERR syntax error")
+			return
+		}
+		i++
+	}
+
+	after := ""
+	if cursor != 0 {
+		var ok bool
+		if after, ok = rs.cursor(cursor); !ok {
+			c.error("ERR invalid cursor")
+			return
+		}
+	}
+	keys := []string{}
+	next := uint64(0)
+	if typ == "string" {
+		page, err := rs.store.Scan(ctx, literalPrefix(pattern), after, count)
+		if c.failed(err) {
+			return
+		}
+		for _, k := range page.Keys {
+			if globMatch(pattern, k) {
+				keys = append(keys, k)
+			}
+		}
+		if page.More {
+			next = rs.newCursor(page.Keys[len(page.Keys)-1])
+		}
+	}
+	c.array(2)
+	c.bulk(strconv.FormatUint(next, 10))
+	c.list(keys)
+}
+
+// newCursor keeps the last key of a page and gives its cursor, the oldest cursor is forgotten if there are too many
+func (rs *RespServer) newCursor(after string) uint64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.cursorId++
+	rs.cursors[rs.cursorId] = after
+	rs.order = append(rs.order, rs.cursorId)
+	if len(rs.order) > RESP_MAX_CURSORS {
+		delete(rs.cursors, rs.order[0])
+		rs.order = rs.order[1:]
+	}
+	return rs.cursorId
+}
+
+// cursor gives the last key of the page of a cursor
+func (rs *RespServer) cursor(id uint64) (string, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	after, ok := rs.cursors[id]
+	return after, ok
+}
+
+// literalPrefix gives the part of a glob pattern before its first special character, matching keys have the prefix
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches a key against a Redis glob pattern: * any bytes, ? a byte, [abc], [^abc], [a-z] a byte of the class
+// and \ escapes the next character
+// Only the last * is backtracked, every other token matches one byte, so matching takes at most len(pattern)*len(s) steps
+func globMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0 // position of the last * in pattern and the byte of s it is retried from
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, next = p, i
+				p++
+				continue
+			case '?':
+				p, i = p+1, i+1
+				continue
+			case '[':
+				if rest, ok := matchClass(pattern[p+1:], s[i]); ok {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+			case '\\':
+				c, n := pattern[p], 1
+				if p+1 < len(pattern) {
+					c, n = pattern[p+1], 2
+				}
+				if c == s[i] {
+					p, i = p+n, i+1
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+		// mismatch, let the last * take one more byte
+		if star < 0 {
+			return false
+		}
+		next++
+		p, i = star+1, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches a byte against a class starting after [, gives the pattern after ]
+// An unterminated class ends with the pattern
+func matchClass(class string, c byte) (string, bool) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for len(class) > 0 && class[0] != ']' {
+		switch {
+		case class[0] == '\\' && len(class) > 1:
+			matched = matched || class[1] == c
+			class = class[2:]
+		case len(class) > 2 && class[1] == '-' && class[2] != ']':
+			lo, hi := class[0], class[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			class = class[3:]
+		default:
+			matched = matched || class[0] == c
+			class = class[1:]
+		}
+	}
+	if len(class) > 0 {
+		class = class[1:]
+	}
+	return class, matched != negate
+}
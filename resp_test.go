@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"goapp/kvstore"
+)
+
+// respClient sends commands as arrays of bulk strings and reads raw replies
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// startResp serves a new store over RESP on a random port
+func startResp(t *testing.T) (*RespServer, *respClient) {
+	s := newService(t, 300, kvstore.PersistanceConfig{Dir: t.TempDir(), Prefix: "RESP", KeepLast: 2})
+	rs := NewRespServer(s)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rs.Serve(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		rs.Shutdown(context.Background())
+	})
+	return rs, &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and gives its raw reply
+func (c *respClient) do(t *testing.T, args ...string) string {
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		cmd += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	return c.reply(t)
+}
+
+// reply reads a reply with its nested replies
+func (c *respClient) reply(t *testing.T) string {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	switch line[0] {
+	case '$':
+		if n >= 0 {
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(c.r, buf); err != nil {
+				t.Fatal(err)
+			}
+			line += string(buf)
+		}
+	case '*', '%':
+		if line[0] == '%' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			line += c.reply(t)
+		}
+	}
+	return line
+}
+
+func TestRespCommands(t *testing.T) {
+	_, c := startResp(t)
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"GET", "key1"}, "$-1\r\n"},
+		{[]string{"SET", "key1", "value1"}, "+OK\r\n"},
+		{[]string{"GET", "key1"}, "$6\r\nvalue1\r\n"},
+		{[]string{"SET", "key1", "x", "NX"}, "$-1\r\n"},
+		{[]string{"SET", "key2", "x", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "key2", "value2", "nx", "ex", "100"}, "+OK\r\n"},
+		{[]string{"TTL", "key2"}, ":100\r\n"},
+		{[]string{"TTL", "key1"}, ":-1\r\n"},
+		{[]string{"TTL", "missing"}, ":-2\r\n"},
+		{[]string{"EXPIRE", "key1", "50"}, ":1\r\n"},
+		{[]string{"TTL", "key1"}, ":50\r\n"},
+		{[]string{"GET", "key1"}, "$6\r\nvalue1\r\n"},
+		{[]string{"EXPIRE", "missing", "50"}, ":0\r\n"},
+		{[]string{"SET", "key1", "x", "EX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "key1", "x", "NX", "XX"}, "-ERR syntax error\r\n"},
+		{[]string{"EXISTS", "key1", "key2", "missing", "key1"}, ":3\r\n"},
+		{[]string{"INCR", "counter"}, ":1\r\n"},
+		{[]string{"INCR", "counter"}, ":2\r\n"},
+		{[]string{"INCR", "key1"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SET", "ratio", "1.5"}, "+OK\r\n"},
+		{[]string{"INCR", "ratio"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"GET", "ratio"}, "$3\r\n1.5\r\n"},
+		{[]string{"KEYS", "key*"}, "*2\r\n$4\r\nkey1\r\n$4\r\nkey2\r\n"},
+		{[]string{"KEYS", "*[2r]"}, "*2\r\n$7\r\ncounter\r\n$4\r\nkey2\r\n"},
+		{[]string{"DEL", "key1", "missing", "counter", "ratio"}, ":3\r\n"},
+		{[]string{"EXPIRE", "key2", "-1"}, ":1\r\n"},
+		{[]string{"EXISTS", "key2"}, ":0\r\n"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"NOSUCH"}, "-ERR unknown command 'NOSUCH'\r\n"},
+		{[]string{"SET", "key3", "x"}, "+OK\r\n"},
+		{[]string{"FLUSHALL"}, "+OK\r\n"},
+		{[]string{"EXISTS", "key3"}, ":0\r\n"},
+	}
+	for _, tc := range cases {
+		if reply := c.do(t, tc.args...); reply != tc.expected {
+			t.Errorf("---> TEST: %v got %q, expected %q", tc.args, reply, tc.expected)
+		}
+	}
+}
+
+func TestRespScan(t *testing.T) {
+	_, c := startResp(t)
+	for i := 0; i < 25; i++ {
+		c.do(t, "SET", "scan"+strconv.Itoa(i), "x")
+	}
+	c.do(t, "SET", "other", "x")
+
+	// walk all pages as clients do, until cursor 0
+	seen := 0
+	cursor := "0"
+	for i := 0; i < 10; i++ {
+		reply := c.do(t, "SCAN", cursor, "MATCH", "scan*", "COUNT", "10")
+		lines := strings.Split(reply, "\r\n")
+		cursor = lines[2]
+		seen += strings.Count(reply, "$") - 1
+		if cursor == "0" {
+			break
+		}
+	}
+	if cursor != "0" || seen != 25 {
+		t.Errorf("---> TEST: SCAN got %v keys, last cursor %v, expected 25 keys", seen, cursor)
+	}
+	if reply := c.do(t, "SCAN", "123456"); reply != "-ERR invalid cursor\r\n" {
+		t.Errorf("---> TEST: SCAN of unknown cursor got %q", reply)
+	}
+}
+
+func TestRespProtocol(t *testing.T) {
+	_, c := startResp(t)
+	if reply := c.do(t, "HELLO", "3"); !strings.HasPrefix(reply, "%7\r\n") || !strings.Contains(reply, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("---> TEST: HELLO 3 got %q", reply)
+	}
+	if reply := c.do(t, "GET", "missing"); reply != "_\r\n" {
+		t.Errorf("---> TEST: RESP3 null got %q", reply)
+	}
+	if reply := c.do(t, "HELLO", "4"); !strings.HasPrefix(reply, "-NOPROTO") {
+		t.Errorf("---> TEST: HELLO 4 got %q", reply)
+	}
+
+	// inline commands and pipelined commands are replied in order
+	c.conn.Write([]byte("PING\r\nSET inline1 value1\r\nGET inline1\r\n"))
+	for _, expected := range []string{"+PONG\r\n", "+OK\r\n", "$6\r\nvalue1\r\n"} {
+		if reply := c.reply(t); reply != expected {
+			t.Errorf("---> TEST: Pipelined got %q, expected %q", reply, expected)
+		}
+	}
+
+	c.conn.Write([]byte("*1\r\n$abc\r\n"))
+	if reply := c.reply(t); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Errorf("---> TEST: Protocol error got %q", reply)
+	}
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("---> TEST: Connection is not closed after a protocol error")
+	}
+}
+
+func TestRespShutdown(t *testing.T) {
+	rs, c := startResp(t)
+	c.do(t, "PING")
+	if err := rs.Shutdown(context.Background()); err != nil {
+		t.Errorf("---> TEST: Shutdown got %v", err)
+	}
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Errorf("---> TEST: Connection is not closed by shutdown")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"key*", "key1", true},
+		{"key*", "ke", false},
+		{"k?y", "key", true},
+		{"k?y", "ky", false},
+		{"*1*2", "a1b2", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`key\*`, "key*", true},
+		{`key\*`, "key1", false},
+		{"a*b?c", "aXbbYc", true},
+		{"*[0-9]", "key", false},
+		// backtracking every * takes exponential time on these
+		{strings.Repeat("*a", 20) + "*b", strings.Repeat("a", 100), false},
+		{strings.Repeat("*a", 20), strings.Repeat("a", 100), true},
+	}
+	for _, tc := range cases {
+		if globMatch(tc.pattern, tc.key) != tc.match {
+			t.Errorf("---> TEST: %q against %q got %v, expected %v", tc.pattern, tc.key, !tc.match, tc.match)
+		}
+	}
+	if prefix := literalPrefix("user:[0-9]*"); prefix != "user:" {
+		t.Errorf("---> TEST: Literal prefix got %q", prefix)
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	// lengths are checked before anything is allocated, announced bulk strings are not allocated before they arrive
+	cases := []struct {
+		input string
+		err   error
+	}{
+		{"*1048577\r\n", errProtocol},
+		{"*2\r\n$536870913\r\n", errProtocol},
+		{"*1048576\r\n$3\r\nGET\r\n", io.EOF},
+		{"*1\r\n$536870912\r\nabc", io.ErrUnexpectedEOF},
+		{"*1\r\n$3\r\nabcde", errProtocol},
+	}
+	for _, tc := range cases {
+		if _, err := readCommand(bufio.NewReader(strings.NewReader(tc.input))); !errors.Is(err, tc.err) {
+			t.Errorf("---> TEST: %q got %v, expected %v", tc.input, err, tc.err)
+		}
+	}
+	args, err := readCommand(bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$70000\r\n" + strings.Repeat("x", 70000) + "\r\n")))
+	if err != nil || len(args) != 2 || len(args[1]) != 70000 {
+		t.Errorf("---> TEST: Bulk string longer than read buffer got %v args, err:%v", len(args), err)
+	}
+}
@@ -1,38 +1,41 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
-	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	//log "github.com/sirupsen/logrus"
-	//"github.com/gorilla/mux"
+	"goapp/kvstore"
 )
 
-var getMyKeyRe *regexp.Regexp = regexp.MustCompile("/api/v1/my/keys/([^/]+)") // Regex for get operation
+var getMyKeyRe *regexp.Regexp = regexp.MustCompile("^/api/v1/my/keys/([^/]+)$")              // Regex for get operation
+var casMyKeyRe *regexp.Regexp = regexp.MustCompile("^/api/v1/my/keys/([^/]+)/cas$")          // Regex for compare and swap operation
+var cadMyKeyRe *regexp.Regexp = regexp.MustCompile("^/api/v1/my/keys/([^/]+)/cad$")          // Regex for compare and delete operation
+var incrMyKeyRe *regexp.Regexp = regexp.MustCompile("^/api/v1/my/keys/([^/]+)/(incr|decr)$") // Regex for increment and decrement operations
 
-const DEFAULT_PERSISTANCE_INTERVAL = 300 // in seconds
+const DEFAULT_OPERATION_TIMEOUT = 10 // in seconds, an operation not completed in time is responded 504
+const RETRY_AFTER = 1                // in seconds, Retry-After header of 503 responses when store is busy
 
-type APIOPERATION int // API operation enum
+const DEFAULT_LIST_LIMIT = 100 // default page size of list operation
+const MAX_LIST_LIMIT = 1000    // max page size of list operation
 
-// Operation enum
-const (
-	CREATE    APIOPERATION = 0
-	GET                    = 1
-	DELETEALL              = 2
-)
-
-// ServerX interface handles create, get, delete all API request
+// ServerX interface handles create, update, get, list, delete, delete all, compare and swap, compare and delete, increment API request
 // Tags request and response with header value x-request-id, if a valid requets id exists in request header uses the same value in response
 // If cannot find a valid request id then creates a new uuid
-// Starts an operation listener to handle each API operation, works on a shared dictionary using channels
-// It listens timer tick event from persistance object, when timer ticks ServerX receives the event from a channel then sends the current dict to persistance object via channel
+// Each API operation is a method call on kvstore.Store, see kvstore.StoreConfig for the engines executing them
 // TODO: authentication, authorization
 // TODO: validate request against swagger/openapi3 document (json schemas)
 // TODO: cosider implementing rate limiting
@@ -43,125 +46,145 @@ type ServerX interface {
 	Handle(w http.ResponseWriter, r *http.Request)
 	Route(w http.ResponseWriter, r *http.Request)
 	Tag(w http.ResponseWriter, r *http.Request)
-	/* Listen for events */
-	StartApiOperationListener()
+	Shutdown(ctx context.Context) error
+	/* Admin endpoint handlers */
+	Snapshot(w http.ResponseWriter, r *http.Request)
+	Snapshots(w http.ResponseWriter, r *http.Request)
+	Restore(w http.ResponseWriter, r *http.Request)
+	Stats(w http.ResponseWriter, r *http.Request)
+	/* Export and import handlers */
+	Export(w http.ResponseWriter, r *http.Request)
+	Import(w http.ResponseWriter, r *http.Request)
 	/* Endpoint handlers */
 	Create(w http.ResponseWriter, r *http.Request)
+	Update(w http.ResponseWriter, r *http.Request)
 	Get(w http.ResponseWriter, r *http.Request)
+	List(w http.ResponseWriter, r *http.Request)
+	Delete(w http.ResponseWriter, r *http.Request)
 	DeleteAll(w http.ResponseWriter, r *http.Request)
+	CompareAndSwap(w http.ResponseWriter, r *http.Request)
+	CompareAndDelete(w http.ResponseWriter, r *http.Request)
+	Increment(w http.ResponseWriter, r *http.Request)
 }
 
-// ServiceX holds the shared dictionary
-// Create, get, delete all operations on the dictionary are performed in go routine as concurrent
-// operationChan is fed by create, get, delete all endpoints
-// persistance object performs file system operations
+// ServiceX serves the shared dictionary of store over HTTP
+// store holds the dict, persists it and journals each write, see kvstore.Store
+// timeout is the operation timeout of endpoint handlers, an operation not completed in time is responded 504
 // TODO: When multiple instances run, changes (writes) on the dict must be synchronized to other instances (in a container environment)
 // TODO: Synch could be done manually, using rest, message broker, or a distributed memory cache like redis, memcache, hazelcast
 type ServiceX struct {
-	dict          map[string]string
-	operationChan chan ApiOperation
-	persistance   *FSPersistance
+	store   *kvstore.Store
+	timeout time.Duration
 }
 
-// NewService creates a service with an optional interval value, default internal is defined as DEFAULT_PERSISTANCE_INTERVAL
-// Initializes dict, operationChan, and persistance
-// peristance checks the file system for a previosly persisted dict
-// Starts a go routine to listen API operations
-// TODO: persistance.RestoreFromPersistance should be considered in a container environment; the current insrance may try to get latest dict from other instances
+var _ ServerX = (*ServiceX)(nil)
+
+// NewService creates a service with an optional time.Duration as operation timeout of endpoint handlers, default is DEFAULT_OPERATION_TIMEOUT seconds
+// Other arguments build the kvstore.Options: persistance interval (int), kvstore.FsyncPolicy, kvstore.PersistanceConfig and kvstore.StoreConfig
+// Returns an error if an argument is of another type or the store cannot be opened
+// TODO: restoring the dict should be considered in a container environment; the current insrance may try to get latest dict from other instances
 // TODO: if cannot get any data from other instances it could try to get latest data from files system as a last option
-func NewService(args ...interface{}) *ServiceX {
-	interval := DEFAULT_PERSISTANCE_INTERVAL
+func NewService(args ...interface{}) (*ServiceX, error) {
+	timeout := DEFAULT_OPERATION_TIMEOUT * time.Second
+	var options kvstore.Options
 	for _, arg := range args {
 		switch t := arg.(type) {
+		case time.Duration:
+			timeout = t
 		case int:
-			interval = t
+			options.Interval = t
+		case kvstore.FsyncPolicy:
+			options.Fsync = t
+		case kvstore.PersistanceConfig:
+			options.Persistance = t
+		case kvstore.StoreConfig:
+			options.Store = t
 		default:
-			panic("Unknown argument")
+			return nil, fmt.Errorf("unknown argument of NewService: %T", arg)
 		}
 	}
-
-	var s ServiceX
-	s.dict = make(map[string]string)
-	s.operationChan = make(chan ApiOperation, 100) // buffered channel
-	s.persistance = NewPersistance(interval)
-	// read backup if exists
-	dict, err := s.persistance.RestoreFromPersistance()
-	if err == nil {
-		s.dict = dict
-		log.Printf("INFO Data recovered from tmp directory. dict.len:%v \r\n", len(s.dict))
+	store, err := kvstore.Open(options)
+	if err != nil {
+		return nil, err
 	}
-	s.StartApiOperationListener()
-	return &s
+	return &ServiceX{store: store, timeout: timeout}, nil
 }
 
-// ApiOperation is data stucture for communication
-// !!! Share Memory By Communicating !!!
-// oper is an enumaration for CREATE, GET, DELETEALL
-// key and value attributes are for receiving data from endpoint handlers
-// respData and ack is used to give response and ack to endpoint listeners
-type ApiOperation struct {
-	oper     APIOPERATION
-	key      string
-	value    string
-	respData chan map[string]string
-	ack      chan bool
+// Shutdown persists the final dict regardless of changes and stops the store
+// HTTP server must be shut down first so that no new operation arrives; in-flight operations are drained before
+// Operations arriving later are responded 503. Returns ctx error if the final persist does not complete in time
+func (s *ServiceX) Shutdown(ctx context.Context) error {
+	return s.store.Close(ctx)
 }
 
-// NewApiOperation initializes an ApiOperation, Endpoint handlers will feed operationChan and get response via ack and respData
-func NewApiOperation() *ApiOperation {
-	var a ApiOperation
-	a.respData = make(chan map[string]string, 1)
-	a.ack = make(chan bool)
-	return &a
+// context gives the context of a store operation of the request, it is done when the client disconnects or the operation timeout passes
+func (s *ServiceX) context(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.timeout)
 }
 
-// StartApiOperationListener waits for events from endpoint handlers and persistance.timer in a go routine
-// the function works on shared dictionary in a go routine, receives data over channel and respond via channel
-func (s *ServiceX) StartApiOperationListener() {
-	go func() {
-		for {
-			select {
-			case t := <-s.persistance.ticker.C:
-				// Got timer tick from persistance
-				//if len(s.dict) > 0 {
-				log.Printf("DEBUG Peristance timer tick at:%v. Send current dict to persistance. Dict.len:%v", t, len(s.dict))
-				s.persistance.persistanceChan <- s.dict
-				//}
-			case apiOp := <-s.operationChan:
-				// Get event from endpoints. Process the event by type
-				switch apiOp.oper {
-				case CREATE:
-					// Add a new key value to dictionary, then respond
-					s.dict[apiOp.key] = apiOp.value
-					apiOp.ack <- true
-				case GET:
-					// Find the value by given key and respond
-					if _, ok := s.dict[apiOp.key]; ok {
-						apiOp.respData <- map[string]string{apiOp.key: s.dict[apiOp.key]}
-						apiOp.ack <- true
-					} else {
-						apiOp.ack <- false
-					}
-				case DELETEALL:
-					s.dict = make(map[string]string)
-					apiOp.ack <- true
-				default:
-					apiOp.ack <- false
-				}
-			}
-		}
-	}()
+// failed responds the errors common to all store operations and returns true, other errors are left to the handler
+// Responds 503 with Retry-After if store is busy, 503 if store is shut down, 504 if the operation exceeds the timeout
+// Nothing is responded if the client is disconnected
+func (s *ServiceX) failed(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, kvstore.ErrQueueFull):
+		w.Header().Set("Retry-After", strconv.Itoa(RETRY_AFTER))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Printf("WARN Operation rejected, store is busy. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(err, kvstore.ErrClosed):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Printf("WARN Operation rejected, store is shut down. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(err, context.DeadlineExceeded):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		log.Printf("WARN Operation timed out after %v. RequestId: %v\r\n", s.timeout, w.Header().Get("x-request-id"))
+	case errors.Is(err, context.Canceled):
+		log.Printf("WARN Operation abandoned, client is disconnected. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), err)
+	default:
+		return false
+	}
+	return true
 }
 
-// Create API operation creates a new key value in dictionary
-// TODO: Create and Update could be seperated using POST and PUT methods
-// @Summary Create a new pair or update existing
+// parseTTL reads time to live in seconds from x-ttl request header, zero means no expiration
+func parseTTL(r *http.Request) (time.Duration, error) {
+	header := r.Header.Get("x-ttl")
+	if header == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, errors.New("x-ttl must be a positive number of seconds")
+	}
+	if seconds > math.MaxInt64/int64(time.Second) {
+		// the duration in nanoseconds would overflow and expire the key at once
+		return 0, fmt.Errorf("x-ttl must not be more than %v seconds", math.MaxInt64/int64(time.Second))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// values converts entries to key value pairs for responses
+func values(entries map[string]kvstore.Entry) map[string]string {
+	pairs := make(map[string]string, len(entries))
+	for k, e := range entries {
+		pairs[k] = e.Value
+	}
+	return pairs
+}
+
+// Create API operation creates all key values of the request body in dictionary as a single operation
+// Responds written pairs, fails with conflict and lists the existing keys if any of the keys exists
+// Optional x-ttl header gives the time to live of created keys in seconds
+// With If-None-Match: * header existing keys fail the precondition instead of conflict
+// @Summary Create new pairs
 // @Description create
 // @Tags GoApp
 // @Accept json
-// @Param pair body map[string]string true "Pair"
-// @Success 201
-// @Failure 500,415,405,404
+// @Param pairs body map[string]string true "Pairs"
+// @Param x-ttl header int false "time to live in seconds"
+// @Param If-None-Match header string false "*"
+// @Success 201 {object} map[string]string
+// @Failure 409 {array} string
+// @Failure 504,503,500,415,412,405,404,400
 // @Router /my/keys [post]
 func (s *ServiceX) Create(w http.ResponseWriter, r *http.Request) {
 	result := make(map[string]string)
@@ -170,57 +193,273 @@ func (s *ServiceX) Create(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, _err.Error(), http.StatusBadRequest)
 		return
 	}
+	if len(result) == 0 {
+		http.Error(w, "body must contain at least one pair", http.StatusBadRequest)
+		return
+	}
+	ttl, _err := parseTTL(r)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Communicate with listener over channel
-	ao := NewApiOperation()
-	ao.oper = CREATE
-	ao.key = reflect.ValueOf(result).MapKeys()[0].String()
-	ao.value = result[ao.key]
-	s.operationChan <- *ao
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	resp, _err := s.store.Create(ctx, result, ttl)
+	if s.failed(w, _err) {
+		return
+	}
 
-	// get the response from listener
-	if ack := <-ao.ack; ack {
+	if _err == nil {
+		jsonStr, _ := json.Marshal(values(resp))
 		w.WriteHeader(http.StatusCreated)
-		log.Printf("INFO Create completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+		w.Write(jsonStr)
+		log.Printf("INFO Create completed. RequestId: %v, pairs:%v\r\n", w.Header().Get("x-request-id"), len(resp))
+	} else if errors.Is(_err, kvstore.ErrConflict) {
+		keys := make([]string, 0, len(resp))
+		for k := range resp {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		jsonStr, _ := json.Marshal(keys)
+		if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+		w.Write(jsonStr)
+		log.Printf("WARN Create conflict, keys exist. RequestId: %v, keys:%v\r\n", w.Header().Get("x-request-id"), keys)
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("ERROR Create failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err.Error())
+		log.Printf("ERROR Create failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+	}
+}
+
+// Update API operation replaces the value of an existing key given as path variable
+// Request body is the same pair format returned by Get; the body must contain the path key
+// When upsert=true query parameter is given a missing key is created instead of failing
+// Optional x-ttl header gives the time to live in seconds, otherwise the key does not expire anymore
+// If-Match replaces the key only if its ETag matches, If-None-Match: * creates the key only if it does not exist
+// A failed precondition responds 412 Precondition Failed
+// @Summary Update existing pair
+// @Description update
+// @Tags GoApp
+// @Accept json
+// @Param key path string true "key"
+// @Param upsert query bool false "create the key if it does not exist"
+// @Param x-ttl header int false "time to live in seconds"
+// @Param If-Match header string false "ETag of the current value"
+// @Param If-None-Match header string false "*"
+// @Param pair body map[string]string true "Pair"
+// @Success 201,204
+// @Failure 504,503,500,415,412,405,404,400
+// @Router /my/keys/{key} [put]
+func (s *ServiceX) Update(w http.ResponseWriter, r *http.Request) {
+	ss := strings.Split(r.URL.Path, "/")
+	key := ss[len(ss)-1]
+
+	result := make(map[string]string)
+	var _err = json.NewDecoder(r.Body).Decode(&result)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, ok := result[key]
+	if !ok || len(result) != 1 {
+		http.Error(w, "body must contain only the pair of the path key", http.StatusBadRequest)
+		return
+	}
+	ttl, _err := parseTTL(r)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	_, existed, _err := s.store.Set(ctx, key, value, kvstore.SetOptions{
+		TTL:         ttl,
+		Upsert:      r.URL.Query().Get("upsert") == "true",
+		IfMatch:     r.Header.Get("If-Match"),
+		IfNoneMatch: strings.TrimSpace(r.Header.Get("If-None-Match")),
+	})
+	if s.failed(w, _err) {
+		return
+	}
+
+	switch {
+	case _err == nil:
+		if existed {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		log.Printf("INFO Update completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrPreconditionFailed):
+		w.WriteHeader(http.StatusPreconditionFailed)
+		log.Printf("WARN Update precondition failed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("WARN Update completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Update failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+	}
+}
+
+// ListResponse is the page returned by List, pairs are given only when values are requested
+// cursor is empty on the last page
+type ListResponse struct {
+	Keys   []string          `json:"keys"`
+	Pairs  map[string]string `json:"pairs,omitempty"`
+	Cursor string            `json:"cursor,omitempty"`
+}
+
+// List API operation lists keys in order, optionally filtered by prefix
+// Pages are limited by limit query parameter, cursor of the response is given to get the next page
+// @Summary List keys
+// @Description list keys
+// @Tags GoApp
+// @Param prefix query string false "key prefix"
+// @Param limit query int false "page size, default 100, max 1000"
+// @Param cursor query string false "cursor of the previous page"
+// @Param values query bool false "include values"
+// @Success 200 {object} ListResponse
+// @Failure 504,503,500,415,405,404,400
+// @Router /my/keys [get]
+func (s *ServiceX) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := DEFAULT_LIST_LIMIT
+	if query.Get("limit") != "" {
+		var _err error
+		limit, _err = strconv.Atoi(query.Get("limit"))
+		if _err != nil || limit <= 0 || limit > MAX_LIST_LIMIT {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(MAX_LIST_LIMIT), http.StatusBadRequest)
+			return
+		}
+	}
+	after, _err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if _err != nil {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	page, _err := s.store.Scan(ctx, query.Get("prefix"), string(after), limit)
+	if s.failed(w, _err) {
+		return
+	} else if _err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR List failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+		return
+	}
+	resp := ListResponse{Keys: page.Keys}
+	if page.More {
+		resp.Cursor = base64.RawURLEncoding.EncodeToString([]byte(page.Keys[len(page.Keys)-1]))
 	}
+	if query.Get("values") == "true" {
+		resp.Pairs = values(page.Entries)
+	}
+
+	jsonStr, _err2 := json.Marshal(resp)
+	if _err2 != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR List failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err2.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	log.Printf("INFO List completed. RequestId: %v, keys:%v\r\n", w.Header().Get("x-request-id"), len(resp.Keys))
+	w.Write(jsonStr)
 }
 
 // Get API operation gets given key and value pair from dictionary by given key as path variable
+// Remaining time to live in seconds is given in x-ttl response header if the key expires
+// Version of the value is given in ETag response header, If-None-Match with the same ETag responds 304 Not Modified
 // @Summary Get pair
 // @Description get pair
 // @Tags GoApp
 // @Param key path string true "key"
 // @Success 200 {string} resp
-// @Failure 500,415,405,404
+// @Param If-None-Match header string false "ETag of a cached value"
+// @Success 304
+// @Header 200 {integer} x-ttl "remaining time to live in seconds"
+// @Header 200 {string} ETag "version of the value"
+// @Failure 504,503,500,415,405,404
 // @Router /my/keys/{key} [get]
 func (s *ServiceX) Get(w http.ResponseWriter, r *http.Request) {
 	ss := strings.Split(r.URL.Path, "/")
 
-	// Communicate with listener over channel
-	ao := NewApiOperation()
-	ao.oper = GET
-	ao.key = ss[len(ss)-1]
-	s.operationChan <- *ao
-
-	var resp map[string]string
-	// get the response from listener
-	if ack := <-ao.ack; ack {
-		resp = <-ao.respData
-		var jsonStr, _err = json.Marshal(resp)
+	// Execute the operation on store
+	key := ss[len(ss)-1]
+	ctx, cancel := s.context(r)
+	defer cancel()
+	e, _err := s.store.Get(ctx, key)
+	if s.failed(w, _err) {
+		return
+	}
+
+	if _err == nil {
+		var jsonStr, _err = json.Marshal(map[string]string{key: e.Value})
 		if _err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Printf("ERROR Get failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err.Error())
 			return
 		}
+		if ttl := e.TTL(time.Now()); ttl > 0 {
+			// remaining seconds rounded up, a key about to expire never shows zero
+			w.Header().Set("x-ttl", strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10))
+		}
+		w.Header().Set("ETag", e.ETag())
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && e.MatchETags(ifNoneMatch, true) {
+			w.WriteHeader(http.StatusNotModified)
+			log.Printf("INFO Get not modified. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		log.Printf("INFO Get completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
 		w.Write(jsonStr)
-	} else {
+	} else if errors.Is(_err, kvstore.ErrNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		log.Printf("WARN Get completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Get failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+	}
+}
+
+// Delete API operation deletes given key from dictionary by given key as path variable
+// @Summary Delete pair
+// @Description delete pair
+// @Tags GoApp
+// @Param key path string true "key"
+// @Success 204
+// @Failure 504,503,500,415,405,404
+// @Router /my/keys/{key} [delete]
+func (s *ServiceX) Delete(w http.ResponseWriter, r *http.Request) {
+	ss := strings.Split(r.URL.Path, "/")
+
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	_err := s.store.Delete(ctx, ss[len(ss)-1])
+	if s.failed(w, _err) {
+		return
+	}
+
+	if _err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("INFO Delete completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	} else if errors.Is(_err, kvstore.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("WARN Delete completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Delete failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
 	}
 }
 
@@ -229,21 +468,208 @@ func (s *ServiceX) Get(w http.ResponseWriter, r *http.Request) {
 // @Description delete all
 // @Tags GoApp
 // @Success 204
-// @Failure 500,415,405,404
+// @Failure 504,503,500,415,405,404
 // @Router /my/keys [delete]
 func (s *ServiceX) DeleteAll(w http.ResponseWriter, r *http.Request) {
-	// Communicate with listener over channel
-	ao := NewApiOperation()
-	ao.oper = DELETEALL
-	s.operationChan <- *ao
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	_err := s.store.DeleteAll(ctx)
+	if s.failed(w, _err) {
+		return
+	}
 
-	// get the response from listener
-	if ack := <-ao.ack; ack {
+	if _err == nil {
 		w.WriteHeader(http.StatusNoContent)
 		log.Printf("INFO DeleteAll completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("ERROR DeleteAll failed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+		log.Printf("ERROR DeleteAll failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+	}
+}
+
+// CompareAndSwapRequest is the body of CompareAndSwap, a missing or null expected value means the key must not exist
+type CompareAndSwapRequest struct {
+	Expected *string `json:"expected"`
+	Value    string  `json:"value"`
+}
+
+// CompareAndDeleteRequest is the body of CompareAndDelete
+type CompareAndDeleteRequest struct {
+	Expected *string `json:"expected"`
+}
+
+// CompareAndSwap API operation writes a new value only if the current value is the expected value
+// The comparison and the write are done in the listener routine as a single atomic operation
+// Responds the new pair and its ETag, or 409 Conflict with the current pair (empty if the key does not exist)
+// Optional x-ttl header gives the time to live of the new value in seconds, useful for locks with a lease
+// @Summary Compare and swap
+// @Description compare and swap
+// @Tags GoApp
+// @Accept json
+// @Param key path string true "key"
+// @Param x-ttl header int false "time to live in seconds"
+// @Param request body CompareAndSwapRequest true "Expected and new value"
+// @Success 200 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Failure 504,503,500,415,405,404,400
+// @Router /my/keys/{key}/cas [post]
+func (s *ServiceX) CompareAndSwap(w http.ResponseWriter, r *http.Request) {
+	var body CompareAndSwapRequest
+	var _err = json.NewDecoder(r.Body).Decode(&body)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, _err := parseTTL(r)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Execute the operation on store
+	key := casMyKeyRe.FindStringSubmatch(r.URL.Path)[1]
+	ctx, cancel := s.context(r)
+	defer cancel()
+	e, exists, _err := s.store.CompareAndSwap(ctx, key, body.Expected, body.Value, ttl)
+	if s.failed(w, _err) {
+		return
+	}
+
+	resp := map[string]string{}
+	if exists {
+		resp[key] = e.Value
+	}
+	jsonStr, _ := json.Marshal(resp)
+	switch {
+	case _err == nil:
+		w.Header().Set("ETag", e.ETag())
+		w.WriteHeader(http.StatusOK)
+		log.Printf("INFO CompareAndSwap completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("WARN CompareAndSwap mismatch. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR CompareAndSwap failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+		return
+	}
+	w.Write(jsonStr)
+}
+
+// CompareAndDelete API operation deletes a key only if the current value is the expected value
+// The comparison and the delete are done in the listener routine as a single atomic operation
+// Responds 404 if the key does not exist, or 409 Conflict with the current pair
+// @Summary Compare and delete
+// @Description compare and delete
+// @Tags GoApp
+// @Accept json
+// @Param key path string true "key"
+// @Param request body CompareAndDeleteRequest true "Expected value"
+// @Success 204
+// @Failure 409 {object} map[string]string
+// @Failure 504,503,500,415,405,404,400
+// @Router /my/keys/{key}/cad [post]
+func (s *ServiceX) CompareAndDelete(w http.ResponseWriter, r *http.Request) {
+	var body CompareAndDeleteRequest
+	var _err = json.NewDecoder(r.Body).Decode(&body)
+	if _err != nil {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Expected == nil {
+		http.Error(w, "expected value is required", http.StatusBadRequest)
+		return
+	}
+
+	// Execute the operation on store
+	key := cadMyKeyRe.FindStringSubmatch(r.URL.Path)[1]
+	ctx, cancel := s.context(r)
+	defer cancel()
+	e, _err := s.store.CompareAndDelete(ctx, key, *body.Expected)
+	if s.failed(w, _err) {
+		return
+	}
+
+	switch {
+	case _err == nil:
+		w.WriteHeader(http.StatusNoContent)
+		log.Printf("INFO CompareAndDelete completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		log.Printf("WARN CompareAndDelete completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrConflict):
+		jsonStr, _ := json.Marshal(map[string]string{key: e.Value})
+		w.WriteHeader(http.StatusConflict)
+		w.Write(jsonStr)
+		log.Printf("WARN CompareAndDelete mismatch. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR CompareAndDelete failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+	}
+}
+
+// IncrementRequest is the body of Increment, delta is 1 if not given
+type IncrementRequest struct {
+	Delta json.Number `json:"delta" swaggertype:"number"`
+}
+
+// Increment API operation adds delta to the numeric value of a key and responds the new pair
+// Decrement subtracts delta using the same operation, a missing key counts as zero
+// Values are integers (int64) unless the value or delta is a fraction, then they are floats
+// Responds 422 Unprocessable Entity if the current value is not a number or the result overflows
+// @Summary Increment or decrement
+// @Description increment or decrement
+// @Tags GoApp
+// @Accept json
+// @Param key path string true "key"
+// @Param op path string true "incr or decr"
+// @Param request body IncrementRequest false "Delta"
+// @Success 200 {object} map[string]string
+// @Failure 504,503,500,422,415,405,404,400
+// @Router /my/keys/{key}/{op} [post]
+func (s *ServiceX) Increment(w http.ResponseWriter, r *http.Request) {
+	body := IncrementRequest{Delta: "1"}
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if _err := decoder.Decode(&body); _err != nil && _err != io.EOF {
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _err := body.Delta.Float64(); _err != nil {
+		http.Error(w, "delta must be a number", http.StatusBadRequest)
+		return
+	}
+	match := incrMyKeyRe.FindStringSubmatch(r.URL.Path)
+	if match[2] == "decr" {
+		if strings.HasPrefix(body.Delta.String(), "-") {
+			body.Delta = json.Number(strings.TrimPrefix(body.Delta.String(), "-"))
+		} else {
+			body.Delta = json.Number("-" + body.Delta.String())
+		}
+	}
+
+	// Execute the operation on store
+	ctx, cancel := s.context(r)
+	defer cancel()
+	e, _err := s.store.Increment(ctx, match[1], body.Delta)
+	if s.failed(w, _err) {
+		return
+	}
+
+	switch {
+	case _err == nil:
+		jsonStr, _ := json.Marshal(map[string]string{match[1]: e.Value})
+		w.Header().Set("ETag", e.ETag())
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStr)
+		log.Printf("INFO Increment completed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	case errors.Is(_err, kvstore.ErrNotNumber):
+		http.Error(w, _err.Error(), http.StatusUnprocessableEntity)
+		log.Printf("WARN Increment failed. RequestId: %v\r\n", w.Header().Get("x-request-id"))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERROR Increment failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
 	}
 }
 
@@ -258,8 +684,8 @@ func (s *ServiceX) Handle(w http.ResponseWriter, r *http.Request) {
 	// set return content-type
 	w.Header().Set("Content-Type", "application/json")
 
-	// check request content-type
-	if r.Header.Get("Content-type") != "application/json" {
+	// check request content-type, import accepts its own formats
+	if r.Header.Get("Content-type") != "application/json" && !(r.URL.Path == "/api/v1/my/import" && importFormat(r) != "") {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		log.Printf("ERROR UnsupportedMediaType. RequestId: %v\r\n", w.Header().Get("x-request-id"))
 		return
@@ -281,10 +707,34 @@ func (s *ServiceX) Route(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case r.Method == "POST" && r.URL.Path == "/api/v1/my/keys":
 		s.Create(w, r)
+	case r.Method == "GET" && r.URL.Path == "/api/v1/my/export":
+		s.Export(w, r)
+	case r.Method == "POST" && r.URL.Path == "/api/v1/my/import":
+		s.Import(w, r)
+	case r.Method == "POST" && r.URL.Path == "/admin/snapshot":
+		s.Snapshot(w, r)
+	case r.Method == "GET" && r.URL.Path == "/admin/snapshots":
+		s.Snapshots(w, r)
+	case r.Method == "POST" && r.URL.Path == "/admin/restore":
+		s.Restore(w, r)
+	case r.Method == "GET" && r.URL.Path == "/admin/stats":
+		s.Stats(w, r)
+	case r.Method == "POST" && casMyKeyRe.MatchString(r.URL.Path):
+		s.CompareAndSwap(w, r)
+	case r.Method == "POST" && cadMyKeyRe.MatchString(r.URL.Path):
+		s.CompareAndDelete(w, r)
+	case r.Method == "POST" && incrMyKeyRe.MatchString(r.URL.Path):
+		s.Increment(w, r)
+	case r.Method == "PUT" && getMyKeyRe.MatchString(r.URL.Path):
+		s.Update(w, r)
+	case r.Method == "GET" && r.URL.Path == "/api/v1/my/keys":
+		s.List(w, r)
 	case r.Method == "GET" && getMyKeyRe.MatchString(r.URL.Path):
 		s.Get(w, r)
 	case r.Method == "DELETE" && r.URL.Path == "/api/v1/my/keys":
 		s.DeleteAll(w, r)
+	case r.Method == "DELETE" && getMyKeyRe.MatchString(r.URL.Path):
+		s.Delete(w, r)
 	default:
 		w.WriteHeader(http.StatusNotFound)
 		log.Printf("ERROR NotFound. RequestId: %v\r\n", w.Header().Get("x-request-id"))
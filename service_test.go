@@ -2,13 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"goapp/client"
+	"goapp/kvstore"
 )
 
 // TODO: having a persistant file or not effects tests !!!!!
@@ -16,7 +24,52 @@ import (
 // TODO: benchmark tests
 
 // use the same server, parrallel executions may be possible
-var s = NewService()
+var s = func() *ServiceX {
+	s, err := NewService()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}()
+
+// newService creates a service of its own for a test, the test stops if the store cannot be opened
+func newService(t *testing.T, args ...interface{}) *ServiceX {
+	s, err := NewService(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends a request to the handler of a service and gives the recorded response
+// header is given as name and value pairs, content-type is application/json unless it is given
+func serve(t *testing.T, s *ServiceX, method string, url string, body string, header ...string) *httptest.ResponseRecorder {
+	req, _err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	req.Header.Add("content-type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] != "" {
+			req.Header.Set(header[i], header[i+1])
+		}
+	}
+	recorder := httptest.NewRecorder()
+	http.HandlerFunc(s.Handle).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestNewServiceErrors(t *testing.T) {
+	for _, args := range [][]interface{}{
+		{"300"},
+		{kvstore.PersistanceConfig{Backend: "redis"}},
+		{kvstore.StoreConfig{Shards: -1}},
+	} {
+		if _, err := NewService(args...); err == nil {
+			t.Errorf("---> TEST: NewService with %v must fail", args)
+		}
+	}
+}
 
 func TestUnsupportedMediaType(t *testing.T) {
 	req, _err := http.NewRequest("GET", "/api/v1/my/keys", nil)
@@ -56,6 +109,69 @@ func TestResponseHasReuestId(t *testing.T) {
 	log.Printf("---> TEST: status: %v response x-request-id: %v", status, recorder.Header().Get("x-request-id"))
 }
 
+func TestList(t *testing.T) {
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys", nil)
+	req0.Header.Add("content-type", "application/json")
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(httptest.NewRecorder(), req0)
+	req1, _ := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"list3": "3", "list1": "1", "list2": "2", "other": "x"}`)))
+	req1.Header.Add("content-type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req1)
+
+	// walk all pages of list* keys, 2 keys per page
+	var keys []string
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		req, _err := http.NewRequest("GET", "/api/v1/my/keys?prefix=list&limit=2&values=true&cursor="+cursor, nil)
+		req.Header.Add("content-type", "application/json")
+		if _err != nil {
+			t.Fatal(_err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		status := recorder.Code
+		if status != http.StatusOK {
+			t.Fatalf("---> TEST: Got %v, expected %v", status, http.StatusOK)
+		}
+		var resp ListResponse
+		if _err1 := json.NewDecoder(recorder.Body).Decode(&resp); _err1 != nil {
+			t.Fatalf("---> TEST: Cannot decode response: %v", recorder.Body.String())
+		}
+		for _, k := range resp.Keys {
+			if resp.Pairs[k] != k[len(k)-1:] {
+				t.Errorf("---> TEST: Response payload is wrong: %v", resp)
+			}
+		}
+		keys = append(keys, resp.Keys...)
+		cursor = resp.Cursor
+		if cursor == "" {
+			break
+		}
+	}
+	if len(keys) != 3 || keys[0] != "list1" || keys[1] != "list2" || keys[2] != "list3" {
+		t.Errorf("---> TEST: Listed keys are wrong: %v", keys)
+	}
+	log.Printf("---> TEST: keys: %v", keys)
+}
+
+func TestListBadLimit(t *testing.T) {
+	req, _err := http.NewRequest("GET", "/api/v1/my/keys?limit=0", nil)
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusBadRequest {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusBadRequest)
+	}
+	log.Printf("---> TEST: status: %v", status)
+}
+
 func TestGetAll_notFoundOrOk(t *testing.T) {
 	req, _err := http.NewRequest("GET", "/api/v1/my/keys", nil)
 	req.Header.Add("content-type", "application/json")
@@ -109,6 +225,11 @@ func TestCreateErr(t *testing.T) {
 }
 
 func TestCreate(t *testing.T) {
+	// key1 may be left from a previous test or restored from persistance, start clean
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/key1", nil)
+	req0.Header.Add("content-type", "application/json")
+	http.HandlerFunc(s.Handle).ServeHTTP(httptest.NewRecorder(), req0)
+
 	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"key1": "value1"}`)))
 	req.Header.Add("content-type", "application/json")
 	if _err != nil {
@@ -149,3 +270,569 @@ func TestCreate(t *testing.T) {
 		t.Errorf("---> TEST: Response payload is wrong: %v", result)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	TestCreate(t)
+	req, _err := http.NewRequest("DELETE", "/api/v1/my/keys/key1", nil)
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusNoContent {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusNoContent)
+	}
+	log.Printf("---> TEST: status: %v", status)
+
+	// deleting the same key again must fail
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req)
+
+	status2 := recorder2.Code
+	if status2 != http.StatusNotFound {
+		t.Errorf("---> TEST: Got %v, expected %v", status2, http.StatusNotFound)
+	}
+	log.Printf("---> TEST: status2: %v", status2)
+}
+
+func TestCreateConflict(t *testing.T) {
+	TestCreate(t)
+	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"key1": "value2"}`)))
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusConflict {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusConflict)
+	}
+	log.Printf("---> TEST: status: %v", status)
+}
+
+func TestUpdate(t *testing.T) {
+	TestCreate(t)
+	req, _err := http.NewRequest("PUT", "/api/v1/my/keys/key1", bytes.NewBuffer([]byte(`{"key1": "value2"}`)))
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusNoContent {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusNoContent)
+	}
+	log.Printf("---> TEST: status: %v", status)
+
+	// get updated one
+	req2, _err2 := http.NewRequest("GET", "/api/v1/my/keys/key1", nil)
+	req2.Header.Add("content-type", "application/json")
+	if _err2 != nil {
+		t.Fatal(_err2)
+	}
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+
+	result := make(map[string]string)
+	var _err1 = json.NewDecoder(recorder2.Body).Decode(&result)
+	if _err1 != nil {
+		t.Errorf("---> TEST: Cannot decode response: %v", recorder2.Body.String())
+	}
+	if result["key1"] != "value2" {
+		t.Errorf("---> TEST: Response payload is wrong: %v", result)
+	}
+}
+
+func TestUpdateNotFoundAndUpsert(t *testing.T) {
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/key2", nil)
+	req0.Header.Add("content-type", "application/json")
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(httptest.NewRecorder(), req0)
+
+	req, _err := http.NewRequest("PUT", "/api/v1/my/keys/key2", bytes.NewBuffer([]byte(`{"key2": "value2"}`)))
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusNotFound {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusNotFound)
+	}
+	log.Printf("---> TEST: status: %v", status)
+
+	req2, _err2 := http.NewRequest("PUT", "/api/v1/my/keys/key2?upsert=true", bytes.NewBuffer([]byte(`{"key2": "value2"}`)))
+	req2.Header.Add("content-type", "application/json")
+	if _err2 != nil {
+		t.Fatal(_err2)
+	}
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+
+	status2 := recorder2.Code
+	if status2 != http.StatusCreated {
+		t.Errorf("---> TEST: Got %v, expected %v", status2, http.StatusCreated)
+	}
+	log.Printf("---> TEST: status2: %v", status2)
+}
+
+func TestCreateBatch(t *testing.T) {
+	for _, key := range []string{"batch1", "batch2", "batch3"} {
+		req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/"+key, nil)
+		req0.Header.Add("content-type", "application/json")
+		http.HandlerFunc(s.Handle).ServeHTTP(httptest.NewRecorder(), req0)
+	}
+
+	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"batch1": "1", "batch2": "2"}`)))
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusCreated {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusCreated)
+	}
+	written := make(map[string]string)
+	if _err1 := json.NewDecoder(recorder.Body).Decode(&written); _err1 != nil || len(written) != 2 || written["batch2"] != "2" {
+		t.Errorf("---> TEST: Response payload is wrong: %v", written)
+	}
+
+	// batch3 must not be written since batch2 exists
+	req2, _err2 := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"batch2": "x", "batch3": "3"}`)))
+	req2.Header.Add("content-type", "application/json")
+	if _err2 != nil {
+		t.Fatal(_err2)
+	}
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+
+	status2 := recorder2.Code
+	if status2 != http.StatusConflict {
+		t.Errorf("---> TEST: Got %v, expected %v", status2, http.StatusConflict)
+	}
+	if body := recorder2.Body.String(); body != `["batch2"]` {
+		t.Errorf("---> TEST: Response payload is wrong: %v", body)
+	}
+
+	req3, _ := http.NewRequest("GET", "/api/v1/my/keys/batch3", nil)
+	req3.Header.Add("content-type", "application/json")
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req3)
+	if recorder3.Code != http.StatusNotFound {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder3.Code, http.StatusNotFound)
+	}
+	log.Printf("---> TEST: status: %v status2: %v", status, status2)
+}
+
+func TestCreateEmptyBody(t *testing.T) {
+	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{}`)))
+	req.Header.Add("content-type", "application/json")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusBadRequest {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusBadRequest)
+	}
+	log.Printf("---> TEST: status: %v", status)
+}
+
+func TestCreateWithTTL(t *testing.T) {
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/ttl1", nil)
+	req0.Header.Add("content-type", "application/json")
+	handler := http.HandlerFunc(s.Handle)
+	handler.ServeHTTP(httptest.NewRecorder(), req0)
+
+	req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"ttl1": "value1"}`)))
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("x-ttl", "1")
+	if _err != nil {
+		t.Fatal(_err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	status := recorder.Code
+	if status != http.StatusCreated {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusCreated)
+	}
+
+	req2, _err2 := http.NewRequest("GET", "/api/v1/my/keys/ttl1", nil)
+	req2.Header.Add("content-type", "application/json")
+	if _err2 != nil {
+		t.Fatal(_err2)
+	}
+	recorder2 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder2, req2)
+	if recorder2.Code != http.StatusOK || recorder2.Header().Get("x-ttl") != "1" {
+		t.Errorf("---> TEST: Got %v with x-ttl %v, expected %v with x-ttl 1", recorder2.Code, recorder2.Header().Get("x-ttl"), http.StatusOK)
+	}
+
+	// key must be gone after it expires
+	time.Sleep(1100 * time.Millisecond)
+	recorder3 := httptest.NewRecorder()
+	handler.ServeHTTP(recorder3, req2)
+	if recorder3.Code != http.StatusNotFound {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder3.Code, http.StatusNotFound)
+	}
+	log.Printf("---> TEST: status: %v", recorder3.Code)
+}
+
+func TestCreateBadTTL(t *testing.T) {
+	// 9223372037 seconds overflows the duration in nanoseconds
+	for _, ttl := range []string{"-5", "0", "abc", "9223372037", "9223372036854775807"} {
+		req, _err := http.NewRequest("POST", "/api/v1/my/keys", bytes.NewBuffer([]byte(`{"ttl2": "value2"}`)))
+		req.Header.Add("content-type", "application/json")
+		req.Header.Add("x-ttl", ttl)
+		if _err != nil {
+			t.Fatal(_err)
+		}
+		recorder := httptest.NewRecorder()
+		handler := http.HandlerFunc(s.Handle)
+		handler.ServeHTTP(recorder, req)
+
+		status := recorder.Code
+		if status != http.StatusBadRequest {
+			t.Errorf("---> TEST: x-ttl %v got %v, expected %v", ttl, status, http.StatusBadRequest)
+		}
+		log.Printf("---> TEST: x-ttl: %v status: %v", ttl, status)
+	}
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	TestCreate(t)
+	handler := http.HandlerFunc(s.Handle)
+
+	etag := serve(t, s, "GET", "/api/v1/my/keys/key1", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("---> TEST: ETag header is missing")
+	}
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key1", `{"key1": "v"}`, "If-Match", `"0"`).Code; status != http.StatusPreconditionFailed {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusPreconditionFailed)
+	}
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key1", `{"key1": "v"}`, "If-Match", etag).Code; status != http.StatusNoContent {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusNoContent)
+	}
+	// the old ETag must not match anymore
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key1", `{"key1": "v"}`, "If-Match", etag).Code; status != http.StatusPreconditionFailed {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusPreconditionFailed)
+	}
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key1", `{"key1": "v"}`, "If-None-Match", "*").Code; status != http.StatusPreconditionFailed {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusPreconditionFailed)
+	}
+
+	// cached value is not modified
+	newEtag := serve(t, s, "GET", "/api/v1/my/keys/key1", "").Header().Get("ETag")
+	req, _ := http.NewRequest("GET", "/api/v1/my/keys/key1", nil)
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("If-None-Match", newEtag)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusNotModified)
+	}
+	// If-None-Match uses weak comparison, If-Match strong comparison
+	req.Header.Set("If-None-Match", "W/"+newEtag)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("---> TEST: Weak If-None-Match got %v, expected %v", recorder.Code, http.StatusNotModified)
+	}
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key1", `{"key1": "v"}`, "If-Match", "W/"+newEtag).Code; status != http.StatusPreconditionFailed {
+		t.Errorf("---> TEST: Weak If-Match got %v, expected %v", status, http.StatusPreconditionFailed)
+	}
+	// a missing key is not found when its precondition passes
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/missing", `{"missing": "v"}`, "If-None-Match", newEtag).Code; status != http.StatusNotFound {
+		t.Errorf("---> TEST: Missing key with If-None-Match got %v, expected %v", status, http.StatusNotFound)
+	}
+
+	// create only
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/key3", nil)
+	req0.Header.Add("content-type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req0)
+	if status := serve(t, s, "PUT", "/api/v1/my/keys/key3", `{"key3": "v"}`, "If-None-Match", "*").Code; status != http.StatusCreated {
+		t.Errorf("---> TEST: Got %v, expected %v", status, http.StatusCreated)
+	}
+	log.Printf("---> TEST: etag: %v new etag: %v", etag, newEtag)
+}
+
+func TestCompareAndSwapAndDelete(t *testing.T) {
+	handler := http.HandlerFunc(s.Handle)
+	req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/lock1", nil)
+	req0.Header.Add("content-type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req0)
+
+	// acquire the lock only if nobody holds it
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cas", `{"expected": null, "value": "owner1"}`); recorder.Code != http.StatusOK {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusOK)
+	}
+	recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cas", `{"value": "owner2"}`)
+	if recorder.Code != http.StatusConflict || recorder.Body.String() != `{"lock1":"owner1"}` {
+		t.Errorf("---> TEST: Got %v %v, expected %v", recorder.Code, recorder.Body.String(), http.StatusConflict)
+	}
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cas", `{"expected": "owner1", "value": "owner2"}`); recorder.Code != http.StatusOK || recorder.Header().Get("ETag") == "" {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusOK)
+	}
+
+	// release the lock only by its owner
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cad", `{"expected": "owner1"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusConflict)
+	}
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cad", `{"expected": "owner2"}`); recorder.Code != http.StatusNoContent {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusNoContent)
+	}
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/lock1/cad", `{"expected": "owner2"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusNotFound)
+	}
+	log.Printf("---> TEST: status: %v", recorder.Code)
+}
+
+func TestIncrement(t *testing.T) {
+	handler := http.HandlerFunc(s.Handle)
+	for _, key := range []string{"counter1", "text1"} {
+		req0, _ := http.NewRequest("DELETE", "/api/v1/my/keys/"+key, nil)
+		req0.Header.Add("content-type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), req0)
+	}
+
+	cases := []struct {
+		path   string
+		body   string
+		result string
+	}{
+		{"/api/v1/my/keys/counter1/incr", ``, `{"counter1":"1"}`},
+		{"/api/v1/my/keys/counter1/incr", `{"delta": 5}`, `{"counter1":"6"}`},
+		{"/api/v1/my/keys/counter1/decr", `{"delta": 2}`, `{"counter1":"4"}`},
+		{"/api/v1/my/keys/counter1/incr", `{"delta": 0.5}`, `{"counter1":"4.5"}`},
+	}
+	for _, c := range cases {
+		recorder := serve(t, s, "POST", c.path, c.body)
+		if recorder.Code != http.StatusOK || recorder.Body.String() != c.result {
+			t.Errorf("---> TEST: Got %v %v, expected %v %v", recorder.Code, recorder.Body.String(), http.StatusOK, c.result)
+		}
+	}
+
+	serve(t, s, "POST", "/api/v1/my/keys", `{"text1": "abc"}`)
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/text1/incr", ``); recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusUnprocessableEntity)
+	}
+	if recorder := serve(t, s, "POST", "/api/v1/my/keys/counter1/incr", `{"delta": "abc"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("---> TEST: Got %v, expected %v", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	s := newService(t, 300, kvstore.PersistanceConfig{Dir: t.TempDir(), Prefix: "EXPORT", KeepLast: 2})
+
+	// merge skips existing keys and counts broken records
+	serve(t, s, "POST", "/api/v1/my/keys", `{"a": "old"}`)
+	rr := serve(t, s, "POST", "/api/v1/my/import", `{"key":"a","value":"new"}
+{"key":"b","value":"2","ttl":60}
+not json
+{"key":"c","value":"x,\"y\""}
+`, "content-type", "application/x-ndjson")
+	var resp ImportResponse
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &resp) != nil || resp != (ImportResponse{Imported: 2, Skipped: 1, Invalid: 1}) {
+		t.Errorf("---> TEST: Merge import got %v %v", rr.Code, rr.Body.String())
+	}
+
+	rr = serve(t, s, "GET", "/api/v1/my/export", "")
+	expected := `{"key":"a","value":"old"}
+{"key":"b","value":"2","ttl":60}
+{"key":"c","value":"x,\"y\""}
+`
+	if rr.Code != http.StatusOK || rr.Body.String() != expected || rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("---> TEST: NDJSON export got %v %q, expected %q", rr.Code, rr.Body.String(), expected)
+	}
+
+	rr = serve(t, s, "GET", "/api/v1/my/export", "", "accept", "text/csv")
+	expected = "key,value,ttl\na,old,\nb,2,60\nc,\"x,\"\"y\"\"\",\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("---> TEST: CSV export got %v %q, expected %q", rr.Code, rr.Body.String(), expected)
+	}
+
+	// replace overwrites existing keys and deletes keys which are not imported
+	rr = serve(t, s, "POST", "/api/v1/my/import?mode=replace", "key,value,ttl\na,new,\nd,4,x\n", "content-type", "text/csv")
+	resp = ImportResponse{}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &resp) != nil || resp != (ImportResponse{Imported: 1, Invalid: 1, Deleted: 2}) {
+		t.Errorf("---> TEST: Replace import got %v %v", rr.Code, rr.Body.String())
+	}
+	rr = serve(t, s, "GET", "/api/v1/my/export", "", "accept", "text/csv")
+	if rr.Body.String() != "key,value,ttl\na,new,\n" {
+		t.Errorf("---> TEST: Export after replace got %q", rr.Body.String())
+	}
+
+	// the header row is always consumed, a key named key is a pair
+	rr = serve(t, s, "POST", "/api/v1/my/import", "key,value,ttl\nkey,1,\n", "content-type", "text/csv")
+	resp = ImportResponse{}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &resp) != nil || resp.Imported != 1 {
+		t.Errorf("---> TEST: Import of key named key got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = serve(t, s, "POST", "/api/v1/my/import", "e,5,\n", "content-type", "text/csv"); rr.Code != http.StatusBadRequest {
+		t.Errorf("---> TEST: CSV without header got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr = serve(t, s, "POST", "/api/v1/my/import?mode=overwrite", "", "content-type", "text/csv"); rr.Code != http.StatusBadRequest {
+		t.Errorf("---> TEST: Unknown mode got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr = serve(t, s, "POST", "/api/v1/my/keys", "", "content-type", "text/csv"); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("---> TEST: CSV create got %v, expected %v", rr.Code, http.StatusUnsupportedMediaType)
+	}
+	if !strings.HasPrefix(exportFormat(&http.Request{Header: http.Header{"Accept": {"application/json, text/csv;q=0.5"}}}), "text/csv") {
+		t.Errorf("---> TEST: Accept with parameters is not parsed")
+	}
+}
+
+func TestStoreErrorResponses(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{kvstore.ErrQueueFull, http.StatusServiceUnavailable},
+		{kvstore.ErrClosed, http.StatusServiceUnavailable},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		if !s.failed(rr, c.err) || rr.Code != c.code {
+			t.Errorf("---> TEST: %v got %v, expected %v", c.err, rr.Code, c.code)
+		}
+	}
+	if rr := httptest.NewRecorder(); s.failed(rr, kvstore.ErrNotFound) {
+		t.Errorf("---> TEST: %v must be responded by the handler", kvstore.ErrNotFound)
+	}
+}
+
+func TestRequestAfterShutdown(t *testing.T) {
+	closed := newService(t, 300, kvstore.PersistanceConfig{Backend: kvstore.BACKEND_MEMORY})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := closed.Shutdown(ctx); err != nil {
+		t.Fatalf("---> TEST: Shutdown failed. err:%v", err)
+	}
+	req, _ := http.NewRequest("GET", "/api/v1/my/keys/key1", nil)
+	req.Header.Add("content-type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(closed.Handle).ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("---> TEST: Got %v after shutdown, expected %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if err := closed.Shutdown(ctx); !errors.Is(err, kvstore.ErrClosed) {
+		t.Errorf("---> TEST: Second shutdown got %v, expected %v", err, kvstore.ErrClosed)
+	}
+}
+
+func TestClientDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, "PUT", "/api/v1/my/keys/gone1?upsert=true", strings.NewReader(`{"gone1": "value1"}`))
+	req.Header.Add("content-type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.Handle).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("---> TEST: Responded %v %v to a disconnected client", rr.Code, rr.Body.String())
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	s := newService(t, 300, kvstore.PersistanceConfig{Dir: t.TempDir(), Prefix: "CLIENT", KeepLast: 2})
+	srv := httptest.NewServer(http.HandlerFunc(s.Handle))
+	defer srv.Close()
+	c := client.NewClient(srv.URL)
+	ctx := context.Background()
+
+	if _, err := c.Create(ctx, map[string]string{"a": "1", "b": "2"}, 0); err != nil {
+		t.Fatalf("---> TEST: Create got %v", err)
+	}
+	_, err := c.Create(ctx, map[string]string{"a": "x", "c": "3"}, 0)
+	var e *client.Error
+	if !errors.Is(err, client.ErrConflict) || !errors.As(err, &e) || len(e.Keys) != 1 || e.Keys[0] != "a" {
+		t.Errorf("---> TEST: Conflicting create got %v, expected conflict of a", err)
+	}
+	if created, err := c.Set(ctx, "c", "3", client.SetOptions{Upsert: true, TTL: time.Minute}); !created || err != nil {
+		t.Errorf("---> TEST: Upsert got %v %v", created, err)
+	}
+	item, err := c.Get(ctx, "c")
+	if err != nil || item.Value != "3" || item.ETag == "" || item.TTL != time.Minute {
+		t.Errorf("---> TEST: Get got %+v %v", item, err)
+	}
+	if _, err := c.Set(ctx, "c", "4", client.SetOptions{IfMatch: `"0"`}); !errors.Is(err, client.ErrPreconditionFailed) {
+		t.Errorf("---> TEST: Stale If-Match got %v, expected %v", err, client.ErrPreconditionFailed)
+	}
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("---> TEST: Get of missing key got %v, expected %v", err, client.ErrNotFound)
+	}
+	if v, err := c.Increment(ctx, "counter", "5"); v != "5" || err != nil {
+		t.Errorf("---> TEST: Increment got %v %v", v, err)
+	}
+	if v, err := c.Decrement(ctx, "counter", "2"); v != "3" || err != nil {
+		t.Errorf("---> TEST: Decrement got %v %v", v, err)
+	}
+	wrong := "9"
+	if _, err := c.CompareAndSwap(ctx, "a", &wrong, "x", 0); !errors.As(err, &e) || e.Current["a"] != "1" {
+		t.Errorf("---> TEST: CompareAndSwap mismatch got %v", err)
+	}
+	if err := c.CompareAndDelete(ctx, "b", "2"); err != nil {
+		t.Errorf("---> TEST: CompareAndDelete got %v", err)
+	}
+
+	page, err := c.List(ctx, client.ListOptions{Limit: 2, Values: true})
+	if err != nil || len(page.Keys) != 2 || page.Cursor == "" || page.Pairs["a"] != "1" {
+		t.Errorf("---> TEST: List got %+v %v", page, err)
+	}
+	page, err = c.List(ctx, client.ListOptions{Limit: 2, Cursor: page.Cursor})
+	if err != nil || len(page.Keys) != 1 || page.Cursor != "" {
+		t.Errorf("---> TEST: Last page got %+v %v", page, err)
+	}
+
+	stream, err := c.Export(ctx, "", client.FORMAT_NDJSON)
+	if err != nil {
+		t.Fatalf("---> TEST: Export got %v", err)
+	}
+	export, _ := io.ReadAll(stream)
+	stream.Close()
+	if err := c.DeleteAll(ctx); err != nil {
+		t.Errorf("---> TEST: DeleteAll got %v", err)
+	}
+	if resp, err := c.Import(ctx, bytes.NewReader(export), client.FORMAT_NDJSON, client.IMPORT_MERGE); err != nil || resp.Imported != 3 {
+		t.Errorf("---> TEST: Import got %+v %v", resp, err)
+	}
+
+	info, err := c.Snapshot(ctx)
+	if err != nil || info.Filename == "" {
+		t.Fatalf("---> TEST: Snapshot got %+v %v", info, err)
+	}
+	if infos, err := c.Snapshots(ctx); err != nil || len(infos) == 0 || infos[0].Filename != info.Filename {
+		t.Errorf("---> TEST: Snapshots got %+v %v", infos, err)
+	}
+	c.Delete(ctx, "a")
+	if keys, err := c.Restore(ctx, info.Filename); err != nil || keys != 3 {
+		t.Errorf("---> TEST: Restore got %v %v", keys, err)
+	}
+	if _, err := c.Restore(ctx, "unknown"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("---> TEST: Restore of unknown file got %v, expected %v", err, client.ErrNotFound)
+	}
+	if stats, err := c.Stats(ctx); err != nil || stats.Keys != 3 || stats.Snapshots == 0 {
+		t.Errorf("---> TEST: Stats got %+v %v", stats, err)
+	}
+	log.Printf("---> TEST: snapshot: %+v", info)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goapp/kvstore"
+)
+
+const IMPORT_CHUNK_SIZE = 1000 // pairs sent to store in one operation while importing
+
+// Export and import formats
+const (
+	FORMAT_NDJSON = "application/x-ndjson" // a JSON record per line
+	FORMAT_CSV    = "text/csv"             // key,value,ttl columns with a header row
+)
+
+// Import modes
+const (
+	IMPORT_MERGE   = "merge"   // existing keys are kept, imported pairs of existing keys are skipped
+	IMPORT_REPLACE = "replace" // store holds only the imported pairs afterwards
+)
+
+// ExportRecord is a pair in NDJSON export and import, ttl is the remaining time to live in seconds, zero never expires
+type ExportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// ImportResponse is the summary of Import
+// skipped counts pairs of existing keys in merge mode and pairs expired before they are written, invalid counts records which cannot be parsed
+// deleted counts keys removed in replace mode since they are not imported
+type ImportResponse struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Invalid  int `json:"invalid"`
+	Deleted  int `json:"deleted"`
+}
+
+// exportFormat chooses export format by Accept header, NDJSON is the default
+func exportFormat(r *http.Request) string {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v)); err == nil && mediaType == FORMAT_CSV {
+			return FORMAT_CSV
+		}
+	}
+	return FORMAT_NDJSON
+}
+
+// importFormat gives import format by Content-Type header, JSON content is read as NDJSON
+// Returns empty string for unsupported content types
+func importFormat(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-type"))
+	switch mediaType {
+	case FORMAT_CSV:
+		return FORMAT_CSV
+	case FORMAT_NDJSON, "application/json":
+		return FORMAT_NDJSON
+	default:
+		return ""
+	}
+}
+
+// Export API operation streams all pairs, NDJSON or CSV by Accept header
+// Pairs are read from store page by page in key order, a page is a consistent view but the whole export is not
+// @Summary Export pairs
+// @Description export all pairs as NDJSON or CSV
+// @Tags GoApp
+// @Produce application/x-ndjson,text/csv
+// @Param prefix query string false "key prefix"
+// @Success 200 {array} ExportRecord
+// @Failure 504,503,500,415,405
+// @Router /my/export [get]
+func (s *ServiceX) Export(w http.ResponseWriter, r *http.Request) {
+	format := exportFormat(r)
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	n := 0
+	after := ""
+	for first := true; ; first = false {
+		// Execute the operation on store
+		ctx, cancel := s.context(r)
+		page, _err := s.store.Scan(ctx, r.URL.Query().Get("prefix"), after, MAX_LIST_LIMIT)
+		cancel()
+		if first {
+			// status is not sent yet, a busy store or timeout is responded
+			if s.failed(w, _err) {
+				return
+			} else if _err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Printf("ERROR Export failed. RequestId: %v, err:%v\r\n", w.Header().Get("x-request-id"), _err)
+				return
+			}
+			w.Header().Set("Content-Type", format)
+			w.WriteHeader(http.StatusOK)
+			if format == FORMAT_CSV {
+				csvWriter = csv.NewWriter(w)
+				csvWriter.Write([]string{"key", "value", "ttl"})
+			}
+		} else if _err != nil {
+			// the response is truncated on failure, the client sees the connection closed early
+			log.Printf("ERROR Export failed after %v pairs. RequestId: %v, err:%v\r\n", n, w.Header().Get("x-request-id"), _err)
+			panic(http.ErrAbortHandler)
+		}
+
+		now := time.Now()
+		for _, k := range page.Keys {
+			record := ExportRecord{Key: k, Value: page.Entries[k].Value}
+			if ttl := page.Entries[k].TTL(now); ttl > 0 {
+				record.TTL = int64((ttl + time.Second - 1) / time.Second)
+			}
+			if csvWriter != nil {
+				ttl := ""
+				if record.TTL > 0 {
+					ttl = strconv.FormatInt(record.TTL, 10)
+				}
+				csvWriter.Write([]string{record.Key, record.Value, ttl})
+			} else {
+				encoder.Encode(record)
+			}
+		}
+		n += len(page.Keys)
+		if csvWriter != nil {
+			csvWriter.Flush()
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !page.More {
+			break
+		}
+		after = page.Keys[len(page.Keys)-1]
+	}
+	log.Printf("INFO Export completed. RequestId: %v, format:%v, pairs:%v\r\n", w.Header().Get("x-request-id"), format, n)
+}
+
+// Import API operation reads pairs in the formats of Export by Content-Type header and writes them in chunks
+// In merge mode existing keys are skipped, in replace mode existing keys are overwritten and keys missing in the import are deleted at the end
+// Records which cannot be parsed are counted as invalid and skipped; if the body cannot be read nothing is deleted
+// @Summary Import pairs
+// @Description import pairs from NDJSON or CSV
+// @Tags GoApp
+// @Accept application/x-ndjson,text/csv
+// @Param mode query string false "merge (default) or replace"
+// @Param records body []ExportRecord true "Records"
+// @Success 200 {object} ImportResponse
+// @Failure 504,503,500,415,405,400
+// @Router /my/import [post]
+func (s *ServiceX) Import(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = IMPORT_MERGE
+	}
+	if mode != IMPORT_MERGE && mode != IMPORT_REPLACE {
+		http.Error(w, "mode must be merge or replace", http.StatusBadRequest)
+		return
+	}
+
+	var resp ImportResponse
+	failed := false // an operation is failed and responded, the rest of the body is read but not imported
+	keep := make(map[string]bool)
+	chunk := make(map[string]kvstore.Entry, IMPORT_CHUNK_SIZE)
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		if failed {
+			return
+		}
+		// Execute the operation on store
+		ctx, cancel := s.context(r)
+		written, _err := s.store.Import(ctx, chunk, mode == IMPORT_REPLACE)
+		cancel()
+		if s.failed(w, _err) {
+			failed = true
+			return
+		} else if _err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			failed = true
+			return
+		}
+		resp.Imported += len(written)
+		resp.Skipped += len(chunk) - len(written)
+		chunk = make(map[string]kvstore.Entry, IMPORT_CHUNK_SIZE)
+	}
+	add := func(record ExportRecord) {
+		if record.Key == "" || record.TTL < 0 {
+			resp.Invalid++
+			return
+		}
+		if _, ok := chunk[record.Key]; ok {
+			flush() // later record of the same key wins
+		}
+		keep[record.Key] = true
+		chunk[record.Key] = kvstore.NewEntry(record.Value, time.Duration(record.TTL)*time.Second, time.Now())
+		if len(chunk) >= IMPORT_CHUNK_SIZE {
+			flush()
+		}
+	}
+
+	var _err error
+	if importFormat(r) == FORMAT_CSV {
+		_err = readCSV(r.Body, add, &resp.Invalid)
+	} else {
+		_err = readNDJSON(r.Body, add, &resp.Invalid)
+	}
+	flush()
+	if failed {
+		log.Printf("ERROR Import failed. RequestId: %v, imported:%v\r\n", w.Header().Get("x-request-id"), resp.Imported)
+		return
+	}
+	if _err != nil {
+		// pairs read so far are imported, nothing is deleted
+		http.Error(w, _err.Error(), http.StatusBadRequest)
+		log.Printf("ERROR Import failed. RequestId: %v, imported:%v, err:%v\r\n", w.Header().Get("x-request-id"), resp.Imported, _err)
+		return
+	}
+
+	if mode == IMPORT_REPLACE {
+		// Execute the operation on store
+		ctx, cancel := s.context(r)
+		defer cancel()
+		deleted, _err := s.store.Retain(ctx, keep)
+		if s.failed(w, _err) {
+			return
+		} else if _err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("ERROR Import failed. RequestId: %v, imported:%v, err:%v\r\n", w.Header().Get("x-request-id"), resp.Imported, _err)
+			return
+		}
+		resp.Deleted = len(deleted)
+	}
+
+	jsonStr, _ := json.Marshal(resp)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonStr)
+	log.Printf("INFO Import completed. RequestId: %v, mode:%v, imported:%v, skipped:%v, invalid:%v, deleted:%v\r\n", w.Header().Get("x-request-id"), mode, resp.Imported, resp.Skipped, resp.Invalid, resp.Deleted)
+}
+
+// readNDJSON reads a record per line, blank lines are ignored
+func readNDJSON(body io.Reader, add func(ExportRecord), invalid *int) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record ExportRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			*invalid++
+			continue
+		}
+		add(record)
+	}
+	return scanner.Err()
+}
+
+// readCSV reads key,value,ttl records after the header row of Export, ttl column is optional
+// A body without the header row fails, so that a key named key is never taken for the header
+func readCSV(body io.Reader, add func(ExportRecord), invalid *int) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	} else if strings.Join(header, ",") != "key,value,ttl" {
+		return fmt.Errorf("csv header row must be key,value,ttl, got %.64v", strings.Join(header, ","))
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			*invalid++
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(row) < 2 || len(row) > 3 {
+			*invalid++
+			continue
+		}
+		record := ExportRecord{Key: row[0], Value: row[1]}
+		if len(row) == 3 && row[2] != "" {
+			ttl, err := strconv.ParseInt(row[2], 10, 64)
+			if err != nil {
+				*invalid++
+				continue
+			}
+			record.TTL = ttl
+		}
+		add(record)
+	}
+}